@@ -0,0 +1,90 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// annex adds archive files to the git-annex repo of their directory,
+// initializing it first if needed, and commits them along with the removal of
+// the archives rotated out. Nothing else in the repo is committed.
+func annex(files, removed []string) error {
+	ctx := context.Background()
+	dir := filepath.Dir(files[0])
+
+	top, err := output(git(ctx, "-C", dir, "rev-parse", "--show-toplevel"))
+	if err != nil {
+		if err := run(git(ctx, "-C", dir, "init", "-q")); err != nil {
+			return err
+		}
+		if err := run(git(ctx, "-C", dir, "annex", "init", "-q",
+			"gh-dl")); err != nil {
+			return err
+		}
+	} else if err := sameDir(dir, top); err != nil {
+		return err
+	}
+
+	args := []string{"-C", dir, "annex", "add", "-q"}
+	paths := []string{"--"}
+	for _, f := range files {
+		args = append(args, filepath.Base(f))
+		paths = append(paths, filepath.Base(f))
+	}
+	if err := run(git(ctx, args...)); err != nil {
+		return err
+	}
+
+	// Archives rotated out before -annex was used were never committed
+	if len(removed) > 0 {
+		out, err := output(git(ctx, append([]string{"-C", dir, "ls-files",
+			"--"}, removed...)...))
+		if err != nil {
+			return err
+		}
+		paths = append(paths, strings.Fields(out)...)
+	}
+
+	return run(git(ctx, append([]string{"-C", dir, "commit", "-q", "-m",
+		"gh-dl archive " + filepath.Base(files[0])}, paths...)...))
+}
+
+// sameDir fails unless dir is the top level of the git repo top, so archives
+// are never committed to a repo the directory is only nested in.
+func sameDir(dir, top string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return err
+	}
+	if top, err = filepath.EvalSymlinks(top); err != nil {
+		return err
+	}
+	if abs != filepath.Clean(top) {
+		return fmt.Errorf("%s is inside the git repo %s, not a repo of its own",
+			dir, top)
+	}
+	return nil
+}
@@ -20,49 +20,307 @@ package main
 
 import (
 	"archive/tar"
+	"bufio"
 	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/pgzip"
+)
+
+// archiver writes a gzipped tarball. It is safe for concurrent use.
+type archiver struct {
+	mu   sync.Mutex
+	err  error
+	out  *fanout
+	w    io.Writer
+	g    gzipWriter
+	b    *blockWriter
+	t    *tar.Writer
+	s    *switchWriter
+	adds int
+
+	// Gzip writer storing compressed files uncompressed, with -smart-compress
+	stored *gzip.Writer
+
+	// First entry of each file content and mode, with -dedup
+	seen map[string]string
+
+	// Table of contents, by repo, with -tree
+	tree map[string]*treeRepo
+}
+
+// origin is the provenance of a repo, stored in PAX records with -pax.
+type origin struct {
+	url  string
+	head string
+}
+
+var (
+	origins   = make(map[string]origin)
+	originsMu sync.Mutex
 )
 
-func archive(base, name string) error {
-	final, err := os.Create(name)
+// setOrigin notes where a repo was cloned from and its HEAD commit.
+func setOrigin(path, url, head string) {
+	originsMu.Lock()
+	origins[path] = origin{url: url, head: head}
+	originsMu.Unlock()
+}
+
+// getOrigin returns the origin of the repo whose top-level entry is name.
+func getOrigin(name string) (origin, bool) {
+	originsMu.Lock()
+	defer originsMu.Unlock()
+	o, ok := origins[name]
+	return o, ok
+}
+
+// gzipWriter compresses an archive: compress/gzip, or pgzip with -gzip-threads.
+type gzipWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// parallelGzip is a pgzip writer keeping its concurrency across resets.
+type parallelGzip struct {
+	*pgzip.Writer
+}
 
+func newParallelGzip(w io.Writer, level int) (parallelGzip, error) {
+	z, err := pgzip.NewWriterLevel(w, level)
 	if err != nil {
-		return err
+		return parallelGzip{}, err
 	}
+	p := parallelGzip{z}
+	return p, p.SetConcurrency(pgzipBlock, gzThreads)
+}
 
-	defer func() {
-		if err != nil {
-			_ = os.Remove(name)
+func (p parallelGzip) Reset(w io.Writer) {
+	p.Writer.Reset(w)
+	_ = p.SetConcurrency(pgzipBlock, gzThreads)
+}
+
+// switchWriter writes to a writer that can be swapped, so the tar stream can
+// move between gzip writers.
+type switchWriter struct {
+	w io.Writer
+}
+
+var (
+	// Topic directory of each repo, with -topics
+	topicDirs   = make(map[string]string)
+	topicDirsMu sync.Mutex
+)
+
+// setTopic notes the topic a repo is archived under.
+func setTopic(path, topic string) {
+	topicDirsMu.Lock()
+	topicDirs[path] = topic
+	topicDirsMu.Unlock()
+}
+
+// topicPath moves an archive entry of a repo under its topic directory.
+// Entries outside repos, such as organization metadata, keep their path.
+func topicPath(name string) string {
+	split := strings.SplitN(name, "/", 3)
+	if len(split) < 2 {
+		return name
+	}
+
+	topicDirsMu.Lock()
+	topic, ok := topicDirs[split[0]+"/"+split[1]]
+	topicDirsMu.Unlock()
+
+	if !ok {
+		return name
+	}
+	return "topics/" + topic + "/" + name
+}
+
+var (
+	// Repos written this run, as true, and the directories above them, as
+	// false, by path, which alone are archived from the work directory with
+	// -delta or -update-only
+	fresh   = make(map[string]bool)
+	freshMu sync.Mutex
+)
+
+// setFresh notes that a repo, or another directory such as organization
+// metadata, was written this run.
+func setFresh(path string) {
+	freshMu.Lock()
+	defer freshMu.Unlock()
+
+	fresh[path] = true
+	for i := strings.LastIndex(path, "/"); i > 0; i = strings.LastIndex(path[:i], "/") {
+		if _, ok := fresh[path[:i]]; !ok {
+			fresh[path[:i]] = false
+		}
+	}
+}
+
+// stale reports whether an entry of the work directory, named relative to it,
+// is left out of the archive for not being written this run. Incremental runs
+// in a work directory only archive what they downloaded, not the clones of
+// earlier runs.
+func stale(name string) bool {
+	if workDir == "" || (delta == "" && !updateOnly) {
+		return false
+	}
+
+	freshMu.Lock()
+	defer freshMu.Unlock()
+
+	if _, ok := fresh[name]; ok {
+		return false
+	}
+	for i := strings.LastIndex(name, "/"); i > 0; i = strings.LastIndex(name[:i], "/") {
+		if fresh[name[:i]] {
+			return false
+		}
+	}
+	return true
+}
+
+// volumeWriter writes to a file, or with a volume size, to numbered volumes of
+// at most that size.
+type volumeWriter struct {
+	name  string
+	size  int64
+	f     *os.File
+	n     int64
+	files []string
+
+	// Why the destination was dropped, with several -o destinations
+	err error
+}
+
+// fanout writes the archive to each -o destination. A destination that fails
+// is reported and dropped, as long as another one is left.
+type fanout struct {
+	vs []*volumeWriter
+	h  hash.Hash
+}
+
+// blockWriter writes in records of a fixed size, zero-padding the last one.
+// With -tar-blocking-factor, it blocks the compressed archive as written to
+// the tape or file.
+type blockWriter struct {
+	w   io.Writer
+	buf []byte
+	n   int
+}
+
+// archive writes the archive, returning the files written to each
+// destination, or nil for those dropped.
+func archive(base string, names []string) ([][]string, string, error) {
+	a, err := newArchiver(names)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err = a.addAll(base); err != nil {
+		a.abort()
+		return nil, "", err
+	}
+
+	err = a.close()
+	return a.files(), a.sum(), err
+}
+
+func newArchiver(names []string) (*archiver, error) {
+	v, err := newFanout(names)
+	if err != nil {
+		return nil, err
+	}
+
+	// Gzip members are written through the blocking, if any
+	var w io.Writer = v
+	var b *blockWriter
+	if blocking > 0 {
+		b = &blockWriter{
+			w:   v,
+			buf: make([]byte, blocking*blockSize),
 		}
-	}()
+		w = b
+	}
 
-	defer final.Close()
+	var g gzipWriter
 
-	var g *gzip.Writer
+	if gzThreads > 1 {
+		g, err = newParallelGzip(w, level)
+	} else {
+		g, err = gzip.NewWriterLevel(w, level)
+	}
 
-	if g, err = gzip.NewWriterLevel(final, level); err != nil {
+	if err != nil {
 		msgs <- msg{
 			s: "gzip level invalid, using default",
 			v: true,
 		}
-		g = gzip.NewWriter(final)
+		if gzThreads > 1 {
+			g, _ = newParallelGzip(w, gzip.DefaultCompression)
+		} else {
+			g = gzip.NewWriter(w)
+		}
+	}
+
+	a := &archiver{
+		out:  v,
+		w:    w,
+		g:    g,
+		b:    b,
+		seen: make(map[string]string),
+	}
+
+	if treeOn {
+		a.tree = make(map[string]*treeRepo)
 	}
-	defer g.Close()
 
-	t := tar.NewWriter(g)
-	defer t.Close()
+	a.s = &switchWriter{g}
 
+	if smart {
+		a.stored, _ = gzip.NewWriterLevel(w, gzip.NoCompression)
+	}
+
+	a.t = tar.NewWriter(a.s)
+
+	return a, nil
+}
+
+// addAll adds every non-empty owner directory in base.
+func (a *archiver) addAll(base string) error {
 	files, err := ioutil.ReadDir(base)
 	if err != nil {
 		return err
 	}
 
 	for _, info := range files {
-		if err = insert(base, t, info); err != nil {
+		cloned, err := ioutil.ReadDir(filepath.Join(base, info.Name()))
+
+		if err != nil {
+			return err
+		}
+
+		if len(cloned) == 0 && pruneEmpty || stale(info.Name()) {
+			continue
+		}
+
+		if err := a.add(base, info.Name()); err != nil {
 			return err
 		}
 	}
@@ -70,57 +328,833 @@ func archive(base, name string) error {
 	return nil
 }
 
-func insert(base string, t *tar.Writer, info os.FileInfo) error {
-	full := filepath.Join(base, info.Name())
-	cloned, err := ioutil.ReadDir(full)
+// add walks base/rel, adding it to the archive under rel. After a failure,
+// the archive is unusable and every later call returns the same error.
+func (a *archiver) add(base, rel string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.err == nil {
+		if byCreated && !strings.ContainsRune(rel, filepath.Separator) {
+			a.err = a.walkOwner(base, rel)
+		} else {
+			a.err = a.walk(base, filepath.Join(base, rel))
+		}
+	}
+
+	if a.err == nil && checkpoint > 0 {
+		if a.adds++; a.adds%checkpoint == 0 {
+			a.err = a.checkpoint()
+		}
+	}
 
+	return a.err
+}
+
+// walkOwner adds the owner directory base/owner with its repos from the
+// oldest to the newest, for -by-created.
+func (a *archiver) walkOwner(base, owner string) error {
+	dir := filepath.Join(base, owner)
+	i, err := os.Lstat(dir)
 	if err != nil {
 		return err
 	}
+	if err := a.insert(base, dir, i); err != nil {
+		return err
+	}
 
-	if len(cloned) == 0 {
-		return nil
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
 	}
 
-	walk := func(path string, i os.FileInfo, err error) error {
-		if err != nil {
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = owner + "/" + f.Name()
+	}
+	sortByCreated(names)
+
+	for _, name := range names {
+		if err := a.walk(base, filepath.Join(base, filepath.FromSlash(name))); err != nil {
 			return err
 		}
+	}
+	return nil
+}
 
-		rel, err := filepath.Rel(base, path)
+// walk adds root and everything under it to the archive, in lexical order.
+// The tree is listed in full before anything is written, so files appearing
+// or disappearing meanwhile do not change the order of the archive.
+func (a *archiver) walk(base, root string) error {
+	var paths []string
+	var infos []os.FileInfo
 
+	err := filepath.Walk(root, func(path string, i os.FileInfo, err error) error {
 		if err != nil {
+			return a.tolerate(skipped{err: err})
+		}
+		if rel, err := filepath.Rel(base, path); err == nil &&
+			stale(filepath.ToSlash(rel)) {
+			if i.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		paths = append(paths, path)
+		infos = append(infos, i)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for n, path := range paths {
+		if err := a.tolerate(a.insert(base, path, infos[n])); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+// tolerate reports and ignores failures to read the clone with
+// -archive-best-effort. Failures to write the archive are never ignored.
+func (a *archiver) tolerate(err error) error {
+	s, ok := err.(skipped)
+	if !ok {
+		return err
+	}
+
+	if !bestEffort {
+		return s.err
+	}
+
+	if s.padded {
+		msgs <- fmt.Errorf("archive: %v, padded with zeros", s.err)
+	} else {
+		msgs <- fmt.Errorf("archive: %v, skipped", s.err)
+	}
+	return nil
+}
+
+// checkpoint ends the current gzip member and syncs it to disk, so everything
+// added so far can be read back even if the archive is never closed.
+func (a *archiver) checkpoint() error {
+	if err := a.t.Flush(); err != nil {
+		return err
+	}
+
+	if err := a.g.Close(); err != nil {
+		return err
+	}
 
-		hdr, err := tar.FileInfoHeader(i, rel)
+	if err := a.out.sync(); err != nil {
+		return err
+	}
+
+	a.g.Reset(a.w)
+	return nil
+}
+
+func (a *archiver) insert(base, path string, i os.FileInfo) error {
+	rel, err := filepath.Rel(base, path)
+
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if i.Mode()&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return skipped{err: err}
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(i, link)
+
+	if err != nil {
+		return err
+	}
+
+	hdr.Name = filepath.ToSlash(rel)
+
+	if perm >= 0 {
+		hdr.Mode = permMode(i.Mode())
+	}
+
+	if tarOwner != nil {
+		hdr.Uid, hdr.Gid = tarOwner.uid, tarOwner.gid
+		hdr.Uname, hdr.Gname = tarOwner.user, tarOwner.group
+	}
+
+	if pax {
+		if o, ok := getOrigin(hdr.Name); ok {
+			hdr.PAXRecords = map[string]string{
+				"GHDL.url": o.url,
+			}
+			if o.head != "" {
+				hdr.PAXRecords["GHDL.head"] = o.head
+			}
+		}
+	}
+
+	if a.tree != nil {
+		a.note(hdr.Name, i)
+	}
+
+	if topicsOn {
+		hdr.Name = topicPath(hdr.Name)
+	}
 
+	// Open the file before writing its header, so a file that cannot be
+	// read can still be skipped
+	var f *os.File
+	if i.Mode().IsRegular() {
+		if f, err = os.Open(path); err != nil {
+			return skipped{err: err}
+		}
+
+		defer f.Close()
+	}
+
+	if dedup && i.Mode().IsRegular() && i.Size() > 0 && immutable(hdr.Name) {
+		sum, err := hashFile(path)
 		if err != nil {
-			return err
+			return skipped{err: err}
+		}
+
+		key := fmt.Sprintf("%x %o", sum, hdr.Mode)
+		if first, ok := a.seen[key]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+			return a.t.WriteHeader(hdr)
 		}
+		a.seen[key] = hdr.Name
+	}
 
-		hdr.Name = filepath.ToSlash(rel)
+	if err := a.t.WriteHeader(hdr); err != nil {
+		return err
+	}
 
-		if err := t.WriteHeader(hdr); err != nil {
-			return err
+	if f == nil {
+		return nil
+	}
+
+	if smart && i.Size() >= storeMin && compressed(path) {
+		return a.store(f, hdr.Size)
+	}
+
+	return a.copyFile(f, hdr.Size)
+}
+
+// copyFile writes the size bytes of a file following its header. With
+// -archive-best-effort, a file that cannot be read in full, or that shrank
+// since its header was written, is padded with zeros to keep the archive
+// intact.
+func (a *archiver) copyFile(f *os.File, size int64) error {
+	if !bestEffort {
+		_, err := io.Copy(a.t, f)
+		return err
+	}
+
+	r := &errReader{r: f}
+	n, err := io.Copy(a.t, io.LimitReader(r, size))
+	if err != nil && r.err == nil {
+		return err
+	}
+
+	if n == size {
+		return nil
+	}
+
+	if _, err := io.CopyN(a.t, zeros{}, size-n); err != nil {
+		return err
+	}
+
+	if r.err == nil {
+		r.err = errors.New(f.Name() + ": shrank while archiving")
+	}
+	return skipped{err: r.err, padded: true}
+}
+
+// store writes the content of an already compressed file in a gzip member of
+// its own, without compressing it again.
+func (a *archiver) store(f *os.File, size int64) error {
+	if err := a.g.Close(); err != nil {
+		return err
+	}
+	a.stored.Reset(a.w)
+	a.s.w = a.stored
+
+	// A skipped file is still written in full, so the member is finished
+	copyErr := a.copyFile(f, size)
+	if _, ok := copyErr.(skipped); copyErr != nil && !ok {
+		return copyErr
+	}
+
+	if err := a.t.Flush(); err != nil {
+		return err
+	}
+
+	if err := a.stored.Close(); err != nil {
+		return err
+	}
+	a.g.Reset(a.w)
+	a.s.w = a.g
+	return copyErr
+}
+
+// close finishes the archive, removing it on failure.
+func (a *archiver) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	err := a.err
+
+	if err == nil && a.tree != nil {
+		err = a.writeTree()
+	}
+
+	if err2 := a.t.Close(); err == nil {
+		err = err2
+	}
+
+	if err2 := a.g.Close(); err == nil {
+		err = err2
+	}
+
+	if a.b != nil {
+		if err2 := a.b.Close(); err == nil {
+			err = err2
+		}
+	}
+
+	if err2 := a.out.Close(); err == nil {
+		err = err2
+	}
+
+	if err != nil {
+		a.out.remove()
+	}
+
+	return err
+}
+
+// files returns the names of the files written to each destination, or nil
+// for those dropped.
+func (a *archiver) files() [][]string {
+	files := make([][]string, len(a.out.vs))
+	for i, v := range a.out.vs {
+		if v.err == nil {
+			files[i] = v.files
 		}
+	}
+	return files
+}
+
+// sum returns the hex SHA-256 of the archive, or of its volumes concatenated.
+func (a *archiver) sum() string {
+	return hex.EncodeToString(a.out.h.Sum(nil))
+}
+
+// abort discards the archive.
+func (a *archiver) abort() {
+	a.mu.Lock()
+	if a.err == nil {
+		a.err = errors.New("archive aborted")
+	}
+	a.mu.Unlock()
+
+	_ = a.close()
+}
 
-		if i.Mode().IsRegular() {
-			f, err := os.Open(path)
+func (s *switchWriter) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
 
-			if err != nil {
-				return err
+func (v *volumeWriter) Write(p []byte) (int, error) {
+	var written int
+
+	for len(p) > 0 {
+		if v.size > 0 && v.n == v.size {
+			if err := v.next(); err != nil {
+				return written, err
 			}
+		}
+
+		chunk := p
+		if v.size > 0 && int64(len(chunk)) > v.size-v.n {
+			chunk = chunk[:v.size-v.n]
+		}
+
+		n, err := v.f.Write(chunk)
+		written += n
+		v.n += int64(n)
+
+		if err != nil {
+			return written, err
+		}
+
+		p = p[n:]
+	}
+
+	return written, nil
+}
+
+// next closes the current volume and starts the next one.
+func (v *volumeWriter) next() error {
+	if err := v.Close(); err != nil {
+		return err
+	}
+
+	name := v.name
+	if v.size > 0 {
+		name = fmt.Sprintf("%s.%03d", v.name, len(v.files)+1)
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	v.f = f
+	v.n = 0
+	v.files = append(v.files, name)
+	return nil
+}
+
+func (v *volumeWriter) Close() error {
+	if v.f == nil {
+		return nil
+	}
+
+	err := v.f.Close()
+	v.f = nil
+	return err
+}
+
+func (v *volumeWriter) sync() error {
+	return v.f.Sync()
+}
+
+// remove deletes every volume written. Destinations that are not regular
+// files, such as devices, are left alone.
+func (v *volumeWriter) remove() {
+	for _, name := range v.files {
+		if i, err := os.Lstat(name); err == nil && i.Mode().IsRegular() {
+			_ = os.Remove(name)
+		}
+	}
+}
+
+// newFanout starts the archive at each of names.
+func newFanout(names []string) (*fanout, error) {
+	o := &fanout{h: sha256.New()}
+	for _, name := range names {
+		o.vs = append(o.vs, &volumeWriter{
+			name: name,
+			size: volumeSize,
+		})
+	}
+
+	if err := o.each((*volumeWriter).next); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *fanout) Write(p []byte) (int, error) {
+	if err := o.each(func(v *volumeWriter) error {
+		_, err := v.Write(p)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+
+	o.h.Write(p)
+	return len(p), nil
+}
+
+func (o *fanout) sync() error {
+	return o.each((*volumeWriter).sync)
+}
+
+func (o *fanout) Close() error {
+	return o.each((*volumeWriter).Close)
+}
+
+// remove deletes every volume written to any destination.
+func (o *fanout) remove() {
+	for _, v := range o.vs {
+		v.remove()
+	}
+}
+
+// each calls fn for every destination left, dropping those it fails for. It
+// returns the error of the last destination, which is never dropped.
+func (o *fanout) each(fn func(*volumeWriter) error) error {
+	for _, v := range o.vs {
+		if v.err != nil {
+			continue
+		}
+
+		err := fn(v)
+		if err == nil {
+			continue
+		}
+
+		if o.left() == 1 {
+			return err
+		}
 
-			defer f.Close()
+		v.err = err
+		_ = v.Close()
+		v.remove()
+		msgs <- fmt.Errorf("archive %s: %v, continuing without it", v.name, err)
+	}
+	return nil
+}
 
-			if _, err := io.Copy(t, f); err != nil {
-				return err
+// left returns the number of destinations not dropped.
+func (o *fanout) left() int {
+	n := 0
+	for _, v := range o.vs {
+		if v.err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (b *blockWriter) Write(p []byte) (int, error) {
+	var written int
+
+	for len(p) > 0 {
+		n := copy(b.buf[b.n:], p)
+		b.n += n
+		p = p[n:]
+
+		if b.n == len(b.buf) {
+			if _, err := b.w.Write(b.buf); err != nil {
+				return written, err
 			}
+			b.n = 0
 		}
 
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close pads and writes the final record.
+func (b *blockWriter) Close() error {
+	if b.n == 0 {
 		return nil
 	}
 
-	return filepath.Walk(full, walk)
+	for i := b.n; i < len(b.buf); i++ {
+		b.buf[i] = 0
+	}
+
+	b.n = 0
+	_, err := b.w.Write(b.buf)
+	return err
+}
+
+// Names of archives created with the default naming.
+var archiveName = regexp.MustCompile(`^gh-dl-([0-9]+)\.tar\.gz(\.[0-9]+)?$`)
+
+// rotate removes all but the newest keep archives in dir that were named by
+// gh-dl, returning the names removed. All volumes of an archive are kept or
+// removed together. Archives annexed by -annex are symlinks and are removed as
+// well.
+func rotate(dir string, keep int) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type old struct {
+		name string
+		time int64
+	}
+
+	var archives []old
+	for _, info := range files {
+		m := archiveName.FindStringSubmatch(info.Name())
+		if m == nil || !info.Mode().IsRegular() &&
+			info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+
+		t, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		archives = append(archives, old{info.Name(), t})
+	}
+
+	sort.Slice(archives, func(i, j int) bool {
+		return archives[i].time > archives[j].time
+	})
+
+	kept := make(map[int64]bool)
+	for _, a := range archives {
+		if len(kept) == keep {
+			break
+		}
+		kept[a.time] = true
+	}
+
+	var removed []string
+	for i := range archives {
+		if kept[archives[i].time] {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(dir, archives[i].name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, archives[i].name)
+
+		msgs <- msg{
+			s: fmt.Sprintf("removed old archive %s", archives[i].name),
+			v: true,
+		}
+	}
+
+	return removed, nil
+}
+
+// verify reads back an archive, given the files of its volumes in order.
+func verify(names []string) error {
+	return readArchive(names, func(*tar.Header, io.Reader) error {
+		return nil
+	})
+}
+
+// readArchive reads an archive, given the files of its volumes in order,
+// calling fn for every entry. Whatever fn does not read of an entry is
+// discarded, so the whole archive is checked.
+func readArchive(names []string, fn func(*tar.Header, io.Reader) error) error {
+	var r []io.Reader
+
+	for _, name := range names {
+		f, err := os.Open(name)
+
+		if err != nil {
+			return err
+		}
+
+		defer f.Close()
+		r = append(r, f)
+	}
+
+	g, err := newGzipMembers(io.MultiReader(r...))
+
+	if err != nil {
+		return err
+	}
+
+	defer g.z.Close()
+
+	t := tar.NewReader(g)
+
+	for {
+		hdr, err := t.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		if err := fn(hdr, t); err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(ioutil.Discard, t); err != nil {
+			return err
+		}
+	}
+
+	// Drain the remaining padding so the gzip checksum is validated.
+	_, err = io.Copy(ioutil.Discard, g)
+	return err
+}
+
+// gzipMembers reads the concatenated gzip members of an archive, ignoring the
+// zeros padding the last record with -tar-blocking-factor, like gzip(1).
+type gzipMembers struct {
+	z *gzip.Reader
+	r *bufio.Reader
+}
+
+func newGzipMembers(r io.Reader) (*gzipMembers, error) {
+	// Buffered, the gzip reader stops at the end of each member
+	m := &gzipMembers{r: bufio.NewReader(r)}
+	z, err := gzip.NewReader(m.r)
+	if err != nil {
+		return nil, err
+	}
+	z.Multistream(false)
+	m.z = z
+	return m, nil
+}
+
+func (m *gzipMembers) Read(p []byte) (int, error) {
+	for {
+		n, err := m.z.Read(p)
+		if err != io.EOF || n > 0 {
+			return n, err
+		}
+		if err := m.next(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// next moves to the next member, returning io.EOF once only zeros are left.
+func (m *gzipMembers) next() error {
+	for {
+		c, err := m.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if c != 0 {
+			break
+		}
+	}
+	if err := m.r.UnreadByte(); err != nil {
+		return err
+	}
+	if err := m.z.Reset(m.r); err != nil {
+		return err
+	}
+	m.z.Multistream(false)
+	return nil
+}
+
+// Extensions of files whose content is already compressed.
+var compressedExts = map[string]bool{
+	".7z": true, ".bundle": true, ".bz2": true, ".gif": true, ".gz": true,
+	".jar": true, ".jpeg": true, ".jpg": true, ".mkv": true, ".mp3": true,
+	".mp4": true, ".pack": true, ".png": true, ".rar": true, ".tgz": true,
+	".webp": true, ".woff2": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+// compressed reports whether a file is already compressed, judging by its
+// extension, such as git packs and bundles.
+func compressed(name string) bool {
+	return compressedExts[strings.ToLower(filepath.Ext(name))]
+}
+
+// immutable reports whether git never modifies an archived file in place, so
+// that restoring it as a hard link is safe. Everything under .git but objects,
+// such as reflogs and the index, is modified in place. Mirrors are entirely
+// git internals.
+func immutable(name string) bool {
+	if mirror {
+		return strings.Contains(name, "/objects/")
+	}
+	return !strings.Contains(name, "/.git/") ||
+		strings.Contains(name, "/.git/objects/")
+}
+
+// skipped is a failure to read a file of a clone, which -archive-best-effort
+// reports without failing the archive. The file is either left out, or padded
+// with zeros if its header was already written.
+type skipped struct {
+	err    error
+	padded bool
+}
+
+func (s skipped) Error() string {
+	return s.err.Error()
+}
+
+// errReader records the first read error of r other than io.EOF.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// zeros is an endless reader of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// hashFile returns the SHA-256 of a file's content.
+func hashFile(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// owner is the fixed ownership of files in the archive.
+type owner struct {
+	uid, gid    int
+	user, group string
+}
+
+// parseOwner parses UID:GID or UID:GID:USER:GROUP. Without names, the archive
+// holds none, so extraction uses the numeric IDs.
+func parseOwner(s string) (*owner, error) {
+	split := strings.Split(s, ":")
+	if len(split) != 2 && len(split) != 4 {
+		return nil, errors.New("want UID:GID or UID:GID:USER:GROUP")
+	}
+
+	uid, err := strconv.ParseUint(split[0], 10, 31)
+	if err != nil {
+		return nil, errors.New("invalid UID")
+	}
+
+	gid, err := strconv.ParseUint(split[1], 10, 31)
+	if err != nil {
+		return nil, errors.New("invalid GID")
+	}
+
+	o := &owner{uid: int(uid), gid: int(gid)}
+	if len(split) == 4 {
+		o.user, o.group = split[2], split[3]
+	}
+	return o, nil
+}
+
+// permMode returns the -perm mode for a file, adding execute permission
+// wherever read permission is granted to directories and executable files.
+func permMode(m os.FileMode) int64 {
+	mode := perm
+
+	switch {
+	case m&os.ModeSymlink != 0:
+		return int64(m.Perm())
+	case m.IsDir(), m&0100 != 0:
+		mode |= (mode & 0444) >> 2
+	}
+
+	return mode
 }
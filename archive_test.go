@@ -0,0 +1,96 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestArchiveBlocking checks that -tar-blocking-factor blocks the compressed
+// archive, and that it still reads back past the padding.
+func TestArchiveBlocking(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+	blocking = 4
+
+	base := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(base, "x", "a"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(base, "x", "a", "f"), []byte("f\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(t.TempDir(), "out.tar.gz")
+	files, _, err := archive(base, []string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(files[0][0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record := int64(blocking * blockSize); info.Size()%record != 0 {
+		t.Errorf("archive is %d bytes, not a multiple of %d", info.Size(), record)
+	}
+
+	got := readAll(t, files[0])
+	if want := map[string]string{"x/a/f": "f\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("archived %v, want %v", got, want)
+	}
+}
+
+func TestArchiveTreeRepos(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+	treeOn = true
+
+	base := t.TempDir()
+	for _, name := range []string{"x/a/f", "x/gists/f", "x/@gists/g/f",
+		"o/@org-meta/members.json", "o/org-meta/f"} {
+		path := filepath.Join(base, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("data\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	name := filepath.Join(t.TempDir(), "out.tar.gz")
+	files, _, err := archive(base, []string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var repos []string
+	for _, line := range strings.Split(readAll(t, files[0])[treeName], "\n") {
+		if line != "" && !strings.HasPrefix(line, "\t") {
+			repos = append(repos, strings.SplitN(line, "\t", 2)[0])
+		}
+	}
+	if want := []string{"o/org-meta", "x/@gists/g", "x/a", "x/gists"}; !reflect.DeepEqual(repos, want) {
+		t.Errorf("tree lists %v, want %v", repos, want)
+	}
+}
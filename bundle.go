@@ -0,0 +1,83 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Name of the bundle replacing a clone with -delta-bundles
+const deltaBundle = "delta.bundle"
+
+// Files and directories written into a clone besides the repo itself, such as
+// by -metadata or -releases, which bundleDelta keeps
+var sideOutputs = map[string]bool{
+	branchDir:       true,
+	releaseDir:      true,
+	tagDir:          true,
+	"issues.json":   true,
+	"metadata.json": true,
+	"pulls.json":    true,
+	"settings.json": true,
+}
+
+// bundleDelta replaces the clone in dir with a git bundle of only what is new
+// since the commit old, the HEAD of the previous run. If old is not in the
+// clone, such as after a force push, or nothing is new, every ref and its
+// history are bundled instead. Side outputs are kept beside the bundle. It
+// reports whether the bundle is partial.
+func bundleDelta(ctx context.Context, dir, old string) (bool, error) {
+	abs, err := filepath.Abs(dir + ".bundle")
+	if err != nil {
+		return false, err
+	}
+
+	args := []string{"-C", dir, "bundle", "create", abs, "--all"}
+
+	n, err := output(git(ctx, "-C", dir, "rev-list", "--count", "--all",
+		"^"+old))
+	partial := err == nil && n != "0"
+	if partial {
+		args = append(args, "^"+old)
+	}
+
+	if err := run(git(ctx, args...)); err != nil {
+		_ = os.Remove(abs)
+		return false, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		_ = os.Remove(abs)
+		return false, err
+	}
+	for _, f := range files {
+		if sideOutputs[f.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, f.Name())); err != nil {
+			_ = os.Remove(abs)
+			return false, err
+		}
+	}
+	return partial, os.Rename(abs, filepath.Join(dir, deltaBundle))
+}
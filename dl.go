@@ -19,45 +19,166 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/google/go-github/github"
 )
 
 type dl struct {
-	git string
-	ssh string
+	git   string
+	ssh   string
+	https string
 
 	fullname string
 	owner    string
+	name     string
 	private  bool
+	fork     bool
+	archived bool
+	local    bool
+	gist     bool
+	size     uint64
+	filter   *filter
+	branches []string
+
+	// Owner of the repo on GitHub, for API calls. The owner directory may
+	// differ from it in case, or for a repo transferred to another owner.
+	login string
+
+	// Discovered page of the repo, whose cursor waits for it with -state
+	page *cursorPage
+
+	// Metadata, for -catalog, -metadata, -topics, and -by-created
+	description string
+	language    string
+	branch      string
+	stars       int
+	topics      []string
+	created     time.Time
 }
 
-func consumeDls(base string, in <-chan dl, wg *sync.WaitGroup) {
+func newDl(r *github.Repository, owner string, f *filter) dl {
+	login := r.GetOwner().GetLogin()
+	if login == "" {
+		login = strings.SplitN(r.GetFullName(), "/", 2)[0]
+	}
+
+	return dl{
+		git:      r.GetGitURL(),
+		ssh:      r.GetSSHURL(),
+		https:    r.GetCloneURL(),
+		fullname: r.GetFullName(),
+		owner:    owner,
+		name:     r.GetName(),
+		login:    login,
+		private:  r.GetPrivate(),
+		fork:     r.GetFork(),
+		archived: r.GetArchived(),
+		size:     uint64(r.GetSize()) << 10,
+		filter:   f,
+
+		description: r.GetDescription(),
+		language:    r.GetLanguage(),
+		branch:      r.GetDefaultBranch(),
+		stars:       r.GetStargazersCount(),
+		topics:      r.Topics,
+		created:     r.GetCreatedAt().Time,
+	}
+}
+
+// path returns the path of a repo in the work directory and archive, as
+// OWNER/NAME. Its owner is as the target named it, which may differ from the
+// full name in case, or for a repo transferred to another owner.
+func (d dl) path() string {
+	return filepath.ToSlash(filepath.Join(d.owner, d.name))
+}
+
+func consumeDls(client *github.Client, base string, in <-chan dl, wg *sync.WaitGroup) {
 	for dl := range in {
-		if excluded[dl.fullname] {
+		if dl.page == nil {
+			consumeDl(client, base, dl, wg)
+			continue
+		}
+
+		// The run waits for the cursor of the page to be saved
+		wg.Add(1)
+		consumeDl(client, base, dl, wg)
+		dl.page.done()
+		wg.Done()
+	}
+}
+
+func consumeDl(client *github.Client, base string, dl dl, wg *sync.WaitGroup) {
+	if dl.filter.excluded(dl.fullname) &&
+		dl.filter.drop(dl.fullname, "excluded") {
+		account(dl.fullname)
+		msgs <- msg{
+			s: fmt.Sprintf("skipped %s", dl.fullname),
+			v: true,
+		}
+		wg.Done()
+		return
+	}
+
+	if reason, err := preFilter(client, dl); err != nil ||
+		dl.filter.drop(dl.fullname, reason) {
+		if err != nil {
+			msgs <- errors.New(dl.fullname + ": " + err.Error())
+		} else {
 			msgs <- msg{
-				s: fmt.Sprintf("skipped %s", dl.fullname),
+				s: fmt.Sprintf("skipped %s: %s", dl.fullname, reason),
 				v: true,
 			}
-			wg.Done()
-			continue
+			account(dl.fullname)
+			atomic.AddUint64(&total, ^uint64(0))
 		}
+		wg.Done()
+		return
+	}
+
+	if estimate {
+		atomic.AddUint64(&estimated, dl.size)
+		wg.Done()
+		return
+	}
 
-		go download(base, dl, wg)
-		time.Sleep(sleep)
+	if catalog {
+		if err := writeCatalog(client, base, dl); err != nil {
+			msgs <- fmt.Errorf("%s: catalog: %v", dl.fullname, err)
+		} else {
+			account(dl.fullname)
+			setFresh(dl.path())
+			atomic.AddUint64(&successful, 1)
+		}
+		wg.Done()
+		pause()
+		return
 	}
+
+	// Every clone takes a -rate token, including the first of each worker
+	pace()
+	download(client, base, dl, wg)
 }
 
-func download(base string, in dl, wg *sync.WaitGroup) {
+func download(client *github.Client, base string, in dl, wg *sync.WaitGroup) {
 	defer wg.Done()
 	ctx := context.Background()
+	key := in.path()
+
+	if byCreated {
+		setCreated(key, in.created)
+	}
 
 	if timeout != 0 {
 		var cancel context.CancelFunc
@@ -65,23 +186,120 @@ func download(base string, in dl, wg *sync.WaitGroup) {
 		defer cancel()
 	}
 
-	args := []string{"-C", filepath.Join(base, in.owner), "clone", "-q",
-		"--no-hardlinks"}
+	if in.local {
+		if _, err := os.Stat(in.git); err != nil {
+			msgs <- errors.New(in.fullname + ": " + err.Error())
+			return
+		}
+	}
 
-	if submodules {
-		args = append(args, "--recurse-submodules", "-j", "16")
+	url, err := cloneURL(in)
+	if err != nil {
+		msgs <- errors.New(in.fullname + ": " + err.Error())
+		return
 	}
 
-	if in.private {
-		args = append(args, in.ssh)
-	} else {
-		args = append(args, in.git)
+	if prev != nil {
+		head, err := remoteHead(ctx, url)
+		if err != nil {
+			msgs <- errors.New(in.fullname + ": " + err.Error())
+			return
+		}
+
+		if head != "" && head == prev[key] {
+			record(key, head, url)
+			msgs <- msg{
+				s: fmt.Sprintf("skipped unchanged repo %s", in.fullname),
+				v: true,
+			}
+			account(in.fullname)
+			atomic.AddUint64(&total, ^uint64(0))
+			atomic.AddUint64(&unchanged, 1)
+			return
+		}
 	}
 
-	cmd := exec.CommandContext(ctx, "git", args...)
+	dir := filepath.Join(base, in.owner, in.name)
+
+	exists := false
+	if workDir != "" {
+		_, err := os.Stat(dir)
+		exists = err == nil
+	}
+
+	if updateOnly && !exists {
+		msgs <- msg{
+			s: fmt.Sprintf("skipped %s: not in work directory", in.fullname),
+			v: true,
+		}
+		account(in.fullname)
+		atomic.AddUint64(&total, ^uint64(0))
+		return
+	}
+
+	if progress {
+		msgs <- msg{
+			s: fmt.Sprintf("starting clone %s", in.fullname),
+			v: true,
+		}
+	}
+
+	start := time.Now()
+	var since time.Time
+	if exists {
+		err = update(ctx, dir)
+	} else if since, err = shallowSince(ctx, client, in); err == nil {
+		// The latest tag is looked up once, not again on every retry
+		for attempt := 0; ; attempt++ {
+			err = clone(ctx, base, in, url, since)
+
+			// Only one protocol may be set up for authentication on this host
+			if alt := alternate(in, url); err != nil && alt != "" &&
+				ctx.Err() == nil && isAuthError(err) {
+				msgs <- msg{
+					s: fmt.Sprintf("%s: authentication failed, retrying %s",
+						in.fullname, alt),
+					v: true,
+				}
+				_ = os.RemoveAll(dir)
+				url = alt
+				err = clone(ctx, base, in, url, since)
+			}
+
+			// Denied access and the -t timeout are not transient
+			if err == nil || attempt == retries || ctx.Err() != nil ||
+				isAuthError(err) {
+				break
+			}
+
+			wait := backoff(attempt)
+			msgs <- msg{
+				s: fmt.Sprintf("%s: %v, retrying in %v", in.fullname, err, wait),
+				v: true,
+			}
+			_ = os.RemoveAll(dir)
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+		}
+	}
+
+	elapsed := time.Since(start)
+
+	if progress {
+		msgs <- msg{
+			s: fmt.Sprintf("finished clone %s", in.fullname),
+			v: true,
+		}
+	}
 
-	if _, err := cmd.Output(); err != nil {
-		_ = os.RemoveAll(filepath.Join(base, in.fullname))
+	if err != nil {
+		// An existing clone is kept as it was
+		if !exists {
+			_ = os.RemoveAll(dir)
+		}
 		if ctx.Err() == context.DeadlineExceeded {
 			err = ctx.Err()
 		}
@@ -89,10 +307,682 @@ func download(base string, in dl, wg *sync.WaitGroup) {
 		return
 	}
 
+	if pruneEmpty {
+		if n, err := commitCount(ctx, dir); err == nil && n == 0 {
+			_ = os.RemoveAll(dir)
+			msgs <- msg{
+				s: fmt.Sprintf("dropped empty repo %s", in.fullname),
+				v: true,
+			}
+			account(in.fullname)
+			atomic.AddUint64(&total, ^uint64(0))
+			atomic.AddUint64(&empty, 1)
+			return
+		}
+	}
+
+	if reason, err := postFilter(ctx, in.filter, in.fullname, dir); err != nil ||
+		in.filter.drop(in.fullname, reason) {
+		_ = os.RemoveAll(dir)
+		if err != nil {
+			msgs <- errors.New(in.fullname + ": " + err.Error())
+			return
+		}
+
+		msgs <- msg{
+			s: fmt.Sprintf("skipped %s: %s", in.fullname, reason),
+			v: true,
+		}
+		account(in.fullname)
+		atomic.AddUint64(&total, ^uint64(0))
+		return
+	}
+
+	// Mirrors already have every branch, without a working tree to check
+	// them out into. -all-branches-checkout checks out the listed ones too.
+	if allBranch {
+		checkoutAll(ctx, in, dir)
+	} else if !mirror && len(in.branches) > 0 {
+		checkoutBranches(ctx, in, dir, in.branches)
+	}
+
+	if tagCount > 0 {
+		snapshotTags(ctx, client, in, dir, url)
+	}
+
+	if compact {
+		if err := gc(dir); err != nil {
+			msgs <- fmt.Errorf("%s: compact: %v", in.fullname, err)
+		}
+	}
+
+	if pushTo != "" {
+		if err := push(ctx, dir, in); err != nil {
+			msgs <- fmt.Errorf("%s: push: %v", in.fullname, err)
+		}
+	}
+
+	if prs && !in.local && !in.gist {
+		if err := writePulls(ctx, client, dir, in); err != nil {
+			msgs <- fmt.Errorf("%s: pull requests: %v", in.fullname, err)
+		}
+	}
+
+	if issues && !in.local && !in.gist {
+		if err := writeIssues(ctx, client, dir, in); err != nil {
+			msgs <- fmt.Errorf("%s: issues: %v", in.fullname, err)
+		}
+	}
+
+	if settingsOn && !in.local && !in.gist {
+		if err := writeSettings(ctx, client, dir, in); err != nil {
+			msgs <- fmt.Errorf("%s: settings: %v", in.fullname, err)
+		}
+	}
+
+	if releases && !in.local && !in.gist {
+		if err := writeReleases(ctx, client, dir, in); err != nil {
+			msgs <- fmt.Errorf("%s: releases: %v", in.fullname, err)
+		}
+	}
+
+	if metaOn {
+		if err := writeMetadata(ctx, dir, in, start); err != nil {
+			msgs <- fmt.Errorf("%s: metadata: %v", in.fullname, err)
+		}
+	}
+
+	if manifest != "" || pax {
+		head, err := output(git(ctx, "-C", dir, "rev-parse", "HEAD"))
+		if err == nil && manifest != "" {
+			record(key, head, url)
+		}
+		if pax {
+			setOrigin(key, url, head)
+		}
+	}
+
+	if topicsOn {
+		topic := noTopic
+		if len(in.topics) > 0 {
+			topic = in.topics[0]
+		}
+		setTopic(key, topic)
+	}
+
+	if old, ok := prev[key]; ok && bundles {
+		partial, err := bundleDelta(ctx, dir, old)
+		if err != nil {
+			_ = os.RemoveAll(dir)
+			msgs <- fmt.Errorf("%s: bundle: %v", in.fullname, err)
+			return
+		}
+
+		if !partial {
+			msgs <- msg{
+				s: fmt.Sprintf("%s: previous HEAD not found or nothing new, "+
+					"bundled in full", in.fullname),
+				v: true,
+			}
+		}
+	}
+
+	if pipe != nil {
+		err := pipe.add(base, filepath.Join(in.owner, in.name))
+		_ = os.RemoveAll(dir)
+		if err != nil {
+			msgs <- errors.New(in.fullname + ": " + err.Error())
+			return
+		}
+	}
+
+	timeClone(key, elapsed)
 	msgs <- msg{
-		s: fmt.Sprintf("downloaded repo %s", in.fullname),
+		s: fmt.Sprintf("downloaded repo %s, cloned in %v", in.fullname,
+			elapsed.Round(time.Millisecond)),
 		v: true,
 	}
 
+	// Repos archived by -pipeline are no longer in the work directory
+	if pipe != nil {
+		dir = ""
+	}
+	accountDownload(in.fullname, dir)
+	setFresh(key)
 	atomic.AddUint64(&successful, 1)
 }
+
+// backoff returns how long to wait before the retry following a failed clone
+// attempt, counted from 0: twice as long as before each time, up to
+// maxRetryWait.
+func backoff(attempt int) time.Duration {
+	wait := retryWait
+	for i := 0; i < attempt && wait < maxRetryWait; i++ {
+		wait *= 2
+	}
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	return wait
+}
+
+// cloneURL returns the URL to clone a repo from: ssh for private repos, or https
+// with -https and a token, and git for public ones, unless -protocol requires a
+// particular one.
+func cloneURL(in dl) (string, error) {
+	url, err := protocolURL(in)
+
+	// The git protocol cannot go through the -socks5 or -rate-limit proxy,
+	// which main rejects when -protocol requires it
+	if err == nil && (socks5 != "" || bandwidth > 0) && !in.local &&
+		url == in.git && in.https != "" {
+		url = in.https
+	}
+
+	return url, err
+}
+
+// protocolURL returns the URL of a repo for the -protocol option.
+func protocolURL(in dl) (string, error) {
+	if in.local {
+		return in.git, nil
+	}
+
+	var url string
+
+	switch protocol {
+	case "":
+		if in.private {
+			if httpsToken && tokenSrc != nil && in.https != "" {
+				return in.https, nil
+			}
+			return in.ssh, nil
+		}
+		return in.git, nil
+	case "https":
+		url = in.https
+	case "ssh":
+		// ssh always authenticates
+		if anonymous(in) {
+			return "", errors.New("-anon-public repos cannot be cloned over ssh")
+		}
+		url = in.ssh
+	case "git":
+		url = in.git
+	}
+
+	if url == "" {
+		return "", fmt.Errorf("no %s URL", protocol)
+	}
+
+	return url, nil
+}
+
+// update fetches new commits into an existing clone of the work directory and
+// fast-forwards its working tree.
+func update(ctx context.Context, dir string) error {
+	if err := run(git(ctx, "-C", dir, "fetch", "-q", "--prune", "--tags",
+		"origin")); err != nil {
+		return err
+	}
+
+	if noCheckout || mirror {
+		return nil
+	}
+
+	// Outputs of the earlier run are written again, and would otherwise stop
+	// the merge if the repo now has files of the same names. Those the repo
+	// already has are not outputs.
+	for name := range sideOutputs {
+		_ = clearSubdir(ctx, dir, name)
+	}
+
+	return run(git(ctx, "-C", dir, "merge", "-q", "--ff-only"))
+}
+
+// alternate returns the ssh URL of a repo for its https URL and vice versa, or
+// "" if there is none or -protocol allows only one.
+func alternate(in dl, url string) string {
+	var alt string
+	switch {
+	case in.local, protocol != "":
+	case url == in.ssh:
+		alt = in.https
+	case url == in.https:
+		alt = in.ssh
+	}
+
+	if alt == url {
+		return ""
+	}
+	return alt
+}
+
+// Git messages of clones failing to authenticate, rather than failing to
+// connect or transfer.
+var authErrors = []string{
+	"Permission denied (publickey",
+	"Authentication failed",
+	"could not read Username",
+	"could not read Password",
+	"terminal prompts disabled",
+	"Host key verification failed",
+	"Repository not found",
+}
+
+// isAuthError reports whether a failed git command was denied access.
+func isAuthError(err error) bool {
+	for _, s := range authErrors {
+		if strings.Contains(err.Error(), s) {
+			return true
+		}
+	}
+	return false
+}
+
+// configList is a repeatable flag of git configuration, as key=value.
+type configList []string
+
+func (c *configList) String() string {
+	return strings.Join(*c, " ")
+}
+
+func (c *configList) Set(s string) error {
+	if !strings.Contains(s, "=") {
+		return errors.New("expected key=value")
+	}
+	*c = append(*c, s)
+	return nil
+}
+
+// anonymous reports whether a repo must be cloned without credentials.
+func anonymous(in dl) bool {
+	return anonPublic && !in.private && !in.local
+}
+
+// clone clones url into base/in.owner/in.name, with history since the given
+// date unless it is zero.
+func clone(ctx context.Context, base string, in dl, url string, since time.Time) error {
+	args := []string{"-C", filepath.Join(base, in.owner), "clone", "-q"}
+
+	if mirror {
+		args = append(args, "--mirror")
+	} else {
+		args = append(args, "--no-hardlinks")
+	}
+
+	if anonymous(in) {
+		args = append([]string{"-c", "credential.helper="}, args...)
+	}
+
+	if noCheckout {
+		args = append(args, "--no-checkout")
+	}
+
+	// Branches named with @ are checked out of the clone, so they are
+	// fetched too. Git ignores the depth of local clones by path.
+	if depth > 0 {
+		single := "--single-branch"
+		if len(in.branches) > 0 {
+			single = "--no-single-branch"
+		}
+		args = append(args, "--depth="+strconv.Itoa(depth), single)
+		if in.local {
+			url = "file://" + url
+		}
+	}
+
+	if !since.IsZero() {
+		args = append(args, "--shallow-since="+since.Format(time.RFC3339))
+	}
+
+	if !submodules {
+		return run(git(ctx, append(args, url, in.name)...))
+	}
+
+	if subSkip != "" {
+		if err := run(git(ctx, append(args, url, in.name)...)); err != nil {
+			return err
+		}
+		updateSubmodules(ctx, in, filepath.Join(base, in.owner, in.name))
+		return nil
+	}
+
+	jobs := subJobs
+	if gitJobs > 0 {
+		jobs = gitJobs
+	}
+
+	recurse := []string{"--recurse-submodules", "-j", strconv.Itoa(jobs)}
+	if depth > 0 {
+		recurse = append(recurse, "--shallow-submodules")
+	}
+
+	err := run(git(ctx, append(append(args, recurse...), url, in.name)...))
+
+	if err == nil || !subErrs || ctx.Err() != nil {
+		return err
+	}
+
+	msgs <- fmt.Errorf("%s: %v, retrying without submodules", in.fullname, err)
+
+	dir := filepath.Join(base, in.owner, in.name)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+
+	if err := run(git(ctx, append(args, url, in.name)...)); err != nil {
+		return err
+	}
+
+	updateSubmodules(ctx, in, dir)
+	return nil
+}
+
+// updateSubmodules fetches each submodule of a clone separately, so one that
+// cannot be fetched does not prevent fetching the rest. Submodules matching
+// -submodule-exclude are not fetched.
+func updateSubmodules(ctx context.Context, in dl, dir string) {
+	out, err := output(git(ctx, "-C", dir, "config", "-f", ".gitmodules",
+		"--get-regexp", `^submodule\..*\.path$`))
+	if err != nil {
+		// No .gitmodules, or no submodules in it.
+		return
+	}
+
+	for _, line := range strings.Split(out, "\n") {
+		split := strings.SplitN(line, " ", 2)
+		if len(split) != 2 {
+			continue
+		}
+
+		path := split[1]
+		if skip, _ := filepath.Match(subSkip, path); skip {
+			msgs <- msg{
+				s: fmt.Sprintf("%s: excluded submodule %s", in.fullname, path),
+				v: true,
+			}
+			continue
+		}
+
+		args := []string{"-C", dir, "submodule", "update", "--init",
+			"--recursive"}
+		if depth > 0 {
+			args = append(args, "--depth="+strconv.Itoa(depth))
+		}
+
+		if err := run(git(ctx, append(args, "--", path)...)); err != nil {
+			msgs <- fmt.Errorf("%s: submodule %s: %v", in.fullname, path, err)
+		}
+	}
+}
+
+// push adds the -push-to remote of a clone and pushes every branch and tag of
+// origin to it.
+func push(ctx context.Context, dir string, in dl) error {
+	url := strings.NewReplacer("{owner}", in.owner, "{repo}", in.name).
+		Replace(pushTo)
+
+	// Unlike remote add, this also works for clones of the work directory
+	if err := run(git(ctx, "-C", dir, "config", "remote.mirror.url",
+		url)); err != nil {
+		return err
+	}
+
+	args := []string{"-C", dir, "push", "-q", "--force", "mirror",
+		"refs/tags/*:refs/tags/*"}
+
+	// Mirror clones keep the branches of origin as their own
+	if mirror {
+		args = append(args, "refs/heads/*:refs/heads/*")
+		return run(git(ctx, args...))
+	}
+
+	branches, err := remoteBranches(ctx, dir)
+	if err != nil {
+		return err
+	}
+	for _, b := range branches {
+		args = append(args, "refs/remotes/origin/"+b+":refs/heads/"+b)
+	}
+
+	return run(git(ctx, args...))
+}
+
+// remoteBranches returns the branches of origin in a clone.
+func remoteBranches(ctx context.Context, dir string) ([]string, error) {
+	out, err := output(git(ctx, "-C", dir, "for-each-ref",
+		"--format=%(refname:strip=3)", "refs/remotes/origin"))
+	if err != nil {
+		return nil, err
+	}
+
+	var branches []string
+	for _, b := range strings.Fields(out) {
+		if b != "HEAD" {
+			branches = append(branches, b)
+		}
+	}
+	return branches, nil
+}
+
+// checkoutAll checks out the working tree of every branch of a clone into
+// branches/<branch>.
+func checkoutAll(ctx context.Context, in dl, dir string) {
+	branches, err := remoteBranches(ctx, dir)
+	if err != nil {
+		msgs <- fmt.Errorf("%s: all branches: %v", in.fullname, err)
+		return
+	}
+
+	checkoutBranches(ctx, in, dir, branches)
+}
+
+// checkoutBranches checks out the working tree of each branch of a clone into
+// branches/<branch>. Checkouts left by an earlier run in the work directory
+// are replaced.
+func checkoutBranches(ctx context.Context, in dl, dir string, branches []string) {
+	if err := clearSubdir(ctx, dir, branchDir); err != nil {
+		msgs <- fmt.Errorf("%s: branches: %v", in.fullname, err)
+		return
+	}
+
+	for _, b := range branches {
+		if err := checkoutBranch(ctx, dir, branchDir+"/"+b, b); err != nil {
+			msgs <- fmt.Errorf("%s: branch %s: %v", in.fullname, b, err)
+		}
+	}
+}
+
+// clearSubdir removes a subdirectory or file gh-dl writes into a clone, left
+// by an earlier run in the work directory. It fails if the repo has its own
+// files there.
+func clearSubdir(ctx context.Context, dir, sub string) error {
+	tracked, err := output(git(ctx, "-C", dir, "ls-files", "--", sub))
+	if err != nil {
+		return err
+	}
+	if tracked != "" {
+		return errors.New(sub + " is part of the repo")
+	}
+	return os.RemoveAll(filepath.Join(dir, sub))
+}
+
+// checkoutBranch checks out the working tree of a branch into the subdirectory
+// sub of a clone. The checkout is a plain directory, without a link back to
+// the clone.
+func checkoutBranch(ctx context.Context, dir, sub, branch string) error {
+	path := filepath.FromSlash(sub)
+
+	// The worktree path is relative to the clone, as is dir to git -C
+	if err := run(git(ctx, "-C", dir, "worktree", "add", "-q", "--detach",
+		path, "refs/remotes/origin/"+branch)); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(dir, path, ".git")); err != nil {
+		return err
+	}
+
+	return run(git(ctx, "-C", dir, "worktree", "prune"))
+}
+
+// gc removes unreachable objects from a clone and repacks it tightly. It is
+// not subject to the clone timeout.
+func gc(dir string) error {
+	ctx := context.Background()
+
+	if err := run(git(ctx, "-C", dir, "reflog", "expire", "--expire=now",
+		"--all")); err != nil {
+		return err
+	}
+
+	return run(git(ctx, "-C", dir, "gc", "-q", "--prune=now", "--aggressive"))
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	b   []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.b = append(t.b, p...)
+	if len(t.b) > t.max {
+		t.b = append(t.b[:0], t.b[len(t.b)-t.max:]...)
+	}
+	return len(p), nil
+}
+
+// run runs cmd, discarding its stdout.
+func run(cmd *exec.Cmd) error {
+	cmd.Stdout = nil
+	return wait(cmd)
+}
+
+// output runs cmd and returns its trimmed stdout.
+func output(cmd *exec.Cmd) (string, error) {
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	if err := wait(cmd); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// wait runs cmd. On failure, the tail of its stderr is included in the error.
+func wait(cmd *exec.Cmd) error {
+	stderr := &tailBuffer{max: stderrMax}
+	cmd.Stderr = stderr
+
+	if err := cmd.Run(); err != nil {
+		if s := strings.TrimSpace(string(stderr.b)); s != "" {
+			return fmt.Errorf("%v: %s", err, s)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// remoteHead returns the commit the remote's HEAD points to, or "" if the
+// remote is empty.
+func remoteHead(ctx context.Context, url string) (string, error) {
+	out, err := output(git(ctx, "ls-remote", url, "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	return strings.SplitN(out, "\t", 2)[0], nil
+}
+
+// userSSH returns where the user set their own ssh command for git, which
+// takes the place of gh-dl's: GIT_SSH_COMMAND, GIT_SSH, or core.sshCommand of
+// -c or, without -isolate, the git configuration. It returns "" if nowhere.
+func userSSH() string {
+	for _, env := range []string{"GIT_SSH_COMMAND", "GIT_SSH"} {
+		if os.Getenv(env) != "" {
+			return env
+		}
+	}
+
+	for _, c := range gitConfig {
+		key := strings.SplitN(c, "=", 2)[0]
+		if strings.EqualFold(key, "core.sshCommand") {
+			return "core.sshCommand"
+		}
+	}
+
+	if isolate {
+		return ""
+	}
+
+	// Outside any repo, so only the system and global configuration apply
+	cmd := exec.Command("git", "config", "--get", "core.sshCommand")
+	cmd.Dir = os.TempDir()
+	if out, err := output(cmd); err == nil && out != "" {
+		return "core.sshCommand"
+	}
+	return ""
+}
+
+// git returns a git command. With -isolate, the host's system and global git
+// configuration and credential helpers are hidden from it.
+func git(ctx context.Context, args ...string) *exec.Cmd {
+	var config []string
+	if isolate {
+		config = append(config, "credential.helper=")
+	}
+	if lowSpeed > 0 {
+		config = append(config, fmt.Sprintf("http.lowSpeedLimit=%d", lowSpeed))
+	}
+	if lowTime > 0 {
+		config = append(config, fmt.Sprintf("http.lowSpeedTime=%d",
+			int64(lowTime/time.Second)))
+	}
+	if gitJobs > 0 {
+		config = append(config, fmt.Sprintf("fetch.parallel=%d", gitJobs),
+			fmt.Sprintf("submodule.fetchJobs=%d", gitJobs))
+	}
+	creds, credEnv := gitCredentials()
+	config = append(config, creds...)
+	config = append(config, gitConfig...)
+
+	pre := make([]string, 0, 2*len(config)+len(args))
+	for _, c := range config {
+		pre = append(pre, "-c", c)
+	}
+	args = append(pre, args...)
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+
+	// Fail instead of waiting for a password or passphrase nobody will enter
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	cmd.Env = append(cmd.Env, credEnv...)
+	if ownSSH == "" {
+		ssh := "ssh -o BatchMode=yes"
+		if socks5 != "" {
+			ssh += " -o ProxyCommand='nc -X 5 -x " + socks5 + " %h %p'"
+		} else if limiter != "" {
+			ssh += " -o ProxyCommand='nc -X connect -x " + limiter + " %h %p'"
+		}
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND="+ssh)
+	}
+
+	if socks5 != "" {
+		// socks5h resolves host names through the proxy too
+		cmd.Env = append(cmd.Env, "ALL_PROXY=socks5h://"+socks5)
+	} else if limiter != "" {
+		cmd.Env = append(cmd.Env, "ALL_PROXY=http://"+limiter)
+	}
+
+	if isolate {
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_NOSYSTEM=1",
+			"HOME="+home,
+			"XDG_CONFIG_HOME="+home)
+	}
+
+	return cmd
+}
@@ -0,0 +1,454 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// downloadAll discovers and clones the repos of queries into a work directory,
+// with the consumeDls workers of main, and returns it.
+func downloadAll(t *testing.T, client *github.Client, queries ...query) string {
+	t.Helper()
+
+	base := t.TempDir()
+	dls := make(chan dl, 100)
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		consumeDls(client, base, dls, &wg)
+	}()
+
+	wg.Add(len(queries))
+	for _, q := range queries {
+		queryOwner(client, base, q, dls, &wg)
+	}
+	wg.Wait()
+	close(dls)
+	<-done
+
+	return base
+}
+
+// readAll returns the content of every regular file in the archive outside of
+// .git directories, by name.
+func readAll(t *testing.T, names []string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	err := readArchive(names, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Typeflag != tar.TypeReg || inGitDir(hdr.Name) {
+			return nil
+		}
+		b, err := ioutil.ReadAll(r)
+		files[hdr.Name] = string(b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// inGitDir reports whether an archived file is git data of a clone.
+func inGitDir(name string) bool {
+	for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+		if filepath.Base(dir) == ".git" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDownloadArchive(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+
+	repos := t.TempDir()
+	f, client := newFakeGitHub(t)
+	f.handleOwner("x", "User", []map[string]interface{}{
+		testRepo("x", "a", bareRepo(t, repos, "a", map[string]string{
+			"README": "a\n",
+			"dir/f":  "f\n",
+		})),
+		testRepo("x", "b", bareRepo(t, repos, "b", map[string]string{
+			"main.go": "package main\n",
+		})),
+	})
+
+	base := downloadAll(t, client, query{kind: queryUser, owner: "x", filter: &filter{}})
+	if successful != 2 || total != 2 {
+		t.Fatalf("downloaded %d/%d repos, want 2/2", successful, total)
+	}
+
+	name := filepath.Join(t.TempDir(), "out.tar.gz")
+	files, _, err := archive(base, []string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := readAll(t, files[0])
+	want := map[string]string{
+		"x/a/README":  "a\n",
+		"x/a/dir/f":   "f\n",
+		"x/b/main.go": "package main\n",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("archived %v, want %v", got, want)
+	}
+}
+
+func TestDownloadOwnerCase(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+	pruneEmpty = true
+	manifest = filepath.Join(t.TempDir(), "manifest.json")
+
+	// The target names the owner in a different case than its login
+	repos := t.TempDir()
+	f, client := newFakeGitHub(t)
+	f.handleOwner("X", "User", []map[string]interface{}{
+		testRepo("x", "a", bareRepo(t, repos, "a", map[string]string{"f": "a\n"})),
+	})
+
+	base := downloadAll(t, client, query{kind: queryUser, owner: "X", filter: &filter{}})
+	if successful != 1 || total != 1 || empty != 0 {
+		t.Fatalf("downloaded %d/%d repos, %d empty, want 1/1, 0 empty",
+			successful, total, empty)
+	}
+	if _, ok := heads["X/a"]; !ok {
+		t.Errorf("manifest has %v, want X/a", heads)
+	}
+
+	name := filepath.Join(t.TempDir(), "out.tar.gz")
+	files, _, err := archive(base, []string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := readAll(t, files[0])
+	if want := map[string]string{"X/a/f": "a\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("archived %v, want %v", got, want)
+	}
+}
+
+func TestDownloadTransferredRepo(t *testing.T) {
+	resetGlobals(t)
+	stop := testMsgs(t)
+	prs, issues, releases, settingsOn = true, true, true, true
+
+	// x/old moved to y/new, whose metadata is only found under its new owner
+	repos := t.TempDir()
+	url := bareRepo(t, repos, "new", map[string]string{"f": "new\n"})
+	f, client := newFakeGitHub(t)
+	f.handleJSON("/repos/x/old", testRepo("y", "new", url))
+	f.handleJSON("/repos/y/new", testRepo("y", "new", url))
+	for _, path := range []string{"pulls", "issues", "releases", "branches"} {
+		f.handleJSON("/repos/y/new/"+path, []interface{}{})
+	}
+
+	base := downloadAll(t, client, query{kind: queryRepo, owner: "x", repo: "old",
+		filter: &filter{}})
+	for _, m := range stop() {
+		if err, ok := m.(error); ok {
+			t.Error(err)
+		}
+	}
+	if successful != 1 {
+		t.Fatalf("downloaded %d repos, want 1", successful)
+	}
+
+	for _, name := range []string{"f", "pulls.json", "issues.json",
+		"settings.json"} {
+		if _, err := os.Stat(filepath.Join(base, "x", "new", name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDownloadDeltaUnchanged(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+	manifest = filepath.Join(t.TempDir(), "manifest.json")
+	defer func() { prev = nil }()
+
+	repos := t.TempDir()
+	f, client := newFakeGitHub(t)
+	f.handleOwner("x", "User", []map[string]interface{}{
+		testRepo("x", "a", bareRepo(t, repos, "a", map[string]string{"f": "a\n"})),
+	})
+
+	q := query{kind: queryUser, owner: "x", filter: &filter{}}
+	downloadAll(t, client, q)
+	if successful != 1 {
+		t.Fatalf("downloaded %d repos, want 1", successful)
+	}
+
+	// The next run, fed the manifest of the first, finds nothing new
+	prev = map[string]string{"x/a": heads["x/a"].Head}
+	heads = make(map[string]manifestEntry)
+	queued = make(map[string]bool)
+	successful, total = 0, 0
+
+	downloadAll(t, client, q)
+	if successful != 0 || unchanged != 1 {
+		t.Fatalf("downloaded %d repos, %d unchanged, want 0, 1", successful,
+			unchanged)
+	}
+	if heads["x/a"].Head != prev["x/a"] {
+		t.Errorf("manifest has %v, want x/a carried over", heads)
+	}
+}
+
+func TestUpdateOnlyArchivesRun(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+
+	repos := t.TempDir()
+	url := bareRepo(t, repos, "a", map[string]string{"f": "a\n"})
+	f, client := newFakeGitHub(t)
+	f.handleOwner("x", "User", []map[string]interface{}{testRepo("x", "a", url)})
+
+	// x/a was cloned by an earlier run, and x/b is a clone no longer found
+	workDir = t.TempDir()
+	updateOnly = true
+	defer func() { workDir, updateOnly = "", false }()
+	testGit(t, "", "clone", "-q", url, filepath.Join(workDir, "x", "a"))
+	if err := os.MkdirAll(filepath.Join(workDir, "x", "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(workDir, "x", "b", "f"), []byte("b\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dls := make(chan dl, 10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	queryOwner(client, workDir, query{kind: queryUser, owner: "x", filter: &filter{}},
+		dls, &wg)
+	close(dls)
+	consumeDls(client, workDir, dls, &wg)
+	wg.Wait()
+	if successful != 1 {
+		t.Fatalf("updated %d repos, want 1", successful)
+	}
+
+	name := filepath.Join(t.TempDir(), "out.tar.gz")
+	files, _, err := archive(workDir, []string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := readAll(t, files[0])
+	if want := map[string]string{"x/a/f": "a\n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("archived %v, want %v", got, want)
+	}
+}
+
+func TestReleasesKeepRepoPath(t *testing.T) {
+	resetGlobals(t)
+	stop := testMsgs(t)
+	releases = true
+
+	repos := t.TempDir()
+	f, client := newFakeGitHub(t)
+	f.handleOwner("x", "User", []map[string]interface{}{
+		testRepo("x", "a", bareRepo(t, repos, "a", map[string]string{
+			"releases/notes": "notes\n",
+		})),
+	})
+
+	base := downloadAll(t, client, query{kind: queryUser, owner: "x", filter: &filter{}})
+
+	var errs []string
+	for _, m := range stop() {
+		if err, ok := m.(error); ok {
+			errs = append(errs, err.Error())
+		}
+	}
+	if want := []string{"x/a: releases: releases is part of the repo"}; !reflect.DeepEqual(errs, want) {
+		t.Errorf("reported %q, want %q", errs, want)
+	}
+
+	b, err := os.ReadFile(filepath.Join(base, "x", "a", "releases", "notes"))
+	if err != nil || string(b) != "notes\n" {
+		t.Errorf("releases/notes = %q, %v, want the repo's file", b, err)
+	}
+}
+
+func TestDownloadExcluded(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+
+	repos := t.TempDir()
+	f, client := newFakeGitHub(t)
+	f.handleOwner("x", "User", []map[string]interface{}{
+		testRepo("x", "keep", bareRepo(t, repos, "keep", map[string]string{
+			"f": "keep\n",
+		})),
+		testRepo("x", "skip-me", bareRepo(t, repos, "skip", map[string]string{
+			"f": "skip\n",
+		})),
+	})
+
+	filt := &filter{exclude: []string{"x/skip-*"}}
+	base := downloadAll(t, client, query{kind: queryUser, owner: "x", filter: filt})
+
+	name := filepath.Join(t.TempDir(), "out.tar.gz")
+	files, _, err := archive(base, []string{name})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for n := range readAll(t, files[0]) {
+		got = append(got, n)
+	}
+	sort.Strings(got)
+	if want := []string{"x/keep/f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("archived %v, want %v", got, want)
+	}
+}
+
+func TestDownloadPushMirror(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+
+	repos := t.TempDir()
+	url := bareRepo(t, repos, "a", map[string]string{"f": "a\n"})
+	f, client := newFakeGitHub(t)
+	f.handleOwner("x", "User", []map[string]interface{}{testRepo("x", "a", url)})
+
+	backup := t.TempDir()
+	testGit(t, "", "init", "-q", "--bare", filepath.Join(backup, "a.git"))
+	mirror = true
+	pushTo = filepath.Join(backup, "{repo}.git")
+
+	downloadAll(t, client, query{kind: queryUser, owner: "x", filter: &filter{}})
+	if successful != 1 {
+		t.Fatalf("downloaded %d repos, want 1", successful)
+	}
+
+	want := testRefs(t, filepath.Join(repos, "a.git"))
+	if got := testRefs(t, filepath.Join(backup, "a.git")); got != want {
+		t.Errorf("pushed branches %q, want %q", got, want)
+	}
+}
+
+// testRefs returns the branches of a repo and the commits they point to.
+func testRefs(t *testing.T, dir string) string {
+	t.Helper()
+
+	out, err := exec.Command("git", "-C", dir, "for-each-ref",
+		"refs/heads").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestRecheckWorkDir(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+	recheck = true
+
+	repos := t.TempDir()
+	f, client := newFakeGitHub(t)
+	f.handleOwner("x", "User", []map[string]interface{}{
+		testRepo("x", "a", bareRepo(t, repos, "a", map[string]string{"f": "a\n"})),
+		testRepo("x", "b", bareRepo(t, repos, "b", map[string]string{"f": "b\n"})),
+	})
+
+	base := downloadAll(t, client, query{kind: queryUser, owner: "x", filter: &filter{}})
+	targets := []target{{name: "x", filter: &filter{}}}
+	if n := recheckRepos(client, targets); n != 0 {
+		t.Fatalf("recheck found %d repos missing, want 0", n)
+	}
+
+	// A download gone from the work directory is missing, though accounted for
+	if err := os.RemoveAll(filepath.Join(base, "x", "b")); err != nil {
+		t.Fatal(err)
+	}
+	if n := recheckRepos(client, targets); n != 1 {
+		t.Errorf("recheck found %d repos missing, want 1", n)
+	}
+}
+
+func TestBackoffCapped(t *testing.T) {
+	for attempt, want := range []time.Duration{retryWait, 2 * retryWait, 4 * retryWait} {
+		if got := backoff(attempt); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+
+	// Shifting by the attempt would overflow long before maxRetries
+	for _, attempt := range []int{34, 64, maxRetries} {
+		if got := backoff(attempt); got != maxRetryWait {
+			t.Errorf("backoff(%d) = %v, want %v", attempt, got, maxRetryWait)
+		}
+	}
+}
+
+func TestUserSSH(t *testing.T) {
+	resetGlobals(t)
+	defer func() { gitConfig, isolate = nil, false }()
+
+	// Only the system and global configuration of the test's own home apply
+	t.Setenv("GIT_SSH_COMMAND", "")
+	t.Setenv("GIT_SSH", "")
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", "")
+	if got := userSSH(); got != "" {
+		t.Errorf("userSSH() = %q without an ssh command, want none", got)
+	}
+
+	testGit(t, "", "config", "--global", "core.sshCommand", "ssh -i key")
+	if got := userSSH(); got != "core.sshCommand" {
+		t.Errorf("userSSH() = %q with core.sshCommand configured, want it", got)
+	}
+
+	// -isolate hides the global configuration, but not -c
+	isolate = true
+	if got := userSSH(); got != "" {
+		t.Errorf("userSSH() = %q with -isolate, want none", got)
+	}
+	gitConfig = configList{"core.sshcommand=ssh -i key"}
+	if got := userSSH(); got != "core.sshCommand" {
+		t.Errorf("userSSH() = %q with -c core.sshCommand, want it", got)
+	}
+
+	t.Setenv("GIT_SSH", "plink")
+	if got := userSSH(); got != "GIT_SSH" {
+		t.Errorf("userSSH() = %q with GIT_SSH set, want it", got)
+	}
+}
@@ -0,0 +1,248 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// extractArchive extracts an archive, or with repo only the subtree of that
+// repo, into the current directory.
+func extractArchive(name, repo string) error {
+	names, err := volumes(name)
+	if err != nil {
+		return err
+	}
+
+	// Files of the repo stored as hard links to files of other repos, by link
+	// target, with -dedup
+	missing := make(map[string][]string)
+	found := false
+
+	// Symlinks are created last, so no entry is written through one
+	var symlinks []*tar.Header
+
+	err = readArchive(names, func(hdr *tar.Header, r io.Reader) error {
+		if repo != "" && !inRepo(hdr.Name, repo) {
+			return nil
+		}
+		found = true
+
+		if hdr.Typeflag == tar.TypeLink && repo != "" &&
+			!inRepo(hdr.Linkname, repo) {
+			missing[hdr.Linkname] = append(missing[hdr.Linkname], hdr.Name)
+			return nil
+		}
+
+		if hdr.Typeflag == tar.TypeSymlink {
+			symlinks = append(symlinks, hdr)
+			return nil
+		}
+		return extractEntry(hdr, r)
+	})
+	if err != nil {
+		return err
+	}
+
+	if repo != "" && !found {
+		return fmt.Errorf("%s is not in the archive", repo)
+	}
+
+	if len(missing) > 0 {
+		if err := extractMissing(names, missing); err != nil {
+			return err
+		}
+	}
+
+	for _, hdr := range symlinks {
+		if err := extractEntry(hdr, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractMissing reads the archive again for the content of hard link targets
+// outside the extracted repo, writing it to the links instead. It runs before
+// the symlinks are created.
+func extractMissing(names []string, missing map[string][]string) error {
+	return readArchive(names, func(hdr *tar.Header, r io.Reader) error {
+		links, ok := missing[hdr.Name]
+		if !ok || hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		first := *hdr
+		first.Name = links[0]
+		if err := extractEntry(&first, r); err != nil {
+			return err
+		}
+
+		for _, l := range links[1:] {
+			link := first
+			link.Typeflag = tar.TypeLink
+			link.Name = l
+			link.Linkname = links[0]
+			if err := extractEntry(&link, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// volumes returns the files of an archive: the archive itself, or if it was
+// split with -volume-size, its numbered volumes in order.
+func volumes(name string) ([]string, error) {
+	if _, err := os.Stat(name); err == nil || !os.IsNotExist(err) {
+		return []string{name}, err
+	}
+
+	var names []string
+	for i := 1; ; i++ {
+		v := fmt.Sprintf("%s.%03d", name, i)
+		if _, err := os.Stat(v); os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		names = append(names, v)
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("archive %s does not exist", name)
+	}
+	return names, nil
+}
+
+// inRepo reports whether an entry of the archive belongs to repo, also when
+// archived under a topic with -topics.
+func inRepo(name, repo string) bool {
+	if strings.HasPrefix(name, "topics/") {
+		if split := strings.SplitN(name, "/", 3); len(split) == 3 {
+			name = split[2]
+		}
+	}
+	return name == repo || strings.HasPrefix(name, repo+"/")
+}
+
+// safePath reports whether an archive path stays within the current directory.
+func safePath(name string) bool {
+	name = path.Clean(name)
+	return !path.IsAbs(name) && name != ".." && !strings.HasPrefix(name, "../")
+}
+
+// safeParent reports whether the parent directory of name, as far as it
+// exists, resolves to within the current directory, so that nothing is written
+// through a symlink pointing outside of it.
+func safeParent(name string) (bool, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return false, err
+	}
+	root, err := filepath.EvalSymlinks(wd)
+	if err != nil {
+		return false, err
+	}
+
+	for dir := filepath.Dir(name); ; dir = filepath.Dir(dir) {
+		real, err := filepath.EvalSymlinks(dir)
+		if os.IsNotExist(err) && dir != "." {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+
+		if real, err = filepath.Abs(real); err != nil {
+			return false, err
+		}
+		rel, err := filepath.Rel(root, real)
+		if err != nil {
+			return false, err
+		}
+		return rel != ".." &&
+			!strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+	}
+}
+
+// extractEntry writes an entry of the archive under the current directory.
+func extractEntry(hdr *tar.Header, r io.Reader) error {
+	if !safePath(hdr.Name) {
+		return fmt.Errorf("%s: unsafe path", hdr.Name)
+	}
+	name := filepath.FromSlash(path.Clean(hdr.Name))
+
+	if ok, err := safeParent(name); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s: path through a symlink", hdr.Name)
+	}
+	mode := os.FileMode(hdr.Mode).Perm()
+
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		// Owner write permission is kept to extract the directory's files
+		return os.MkdirAll(name, mode|0700)
+	case tar.TypeReg:
+		// Not written through an existing symlink or into other hard links
+		_ = os.Remove(name)
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return err
+		}
+
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+
+		if err := f.Close(); err != nil {
+			return err
+		}
+		return os.Chtimes(name, hdr.ModTime, hdr.ModTime)
+	case tar.TypeSymlink:
+		_ = os.Remove(name)
+		return os.Symlink(hdr.Linkname, name)
+	case tar.TypeLink:
+		if !safePath(hdr.Linkname) {
+			return fmt.Errorf("%s: unsafe link", hdr.Name)
+		}
+		target := filepath.FromSlash(path.Clean(hdr.Linkname))
+		if ok, err := safeParent(target); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("%s: link through a symlink", hdr.Name)
+		}
+		_ = os.Remove(name)
+		return os.Link(target, name)
+	default:
+		return errors.New(hdr.Name + ": unsupported entry type")
+	}
+}
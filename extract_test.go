@@ -0,0 +1,242 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// chdir changes to dir for the rest of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+}
+
+// writeArchive writes the entries to a compressed archive, taking the content
+// of regular files from data.
+func writeArchive(t *testing.T, name string, hdrs []tar.Header, data map[string]string) {
+	t.Helper()
+
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	z := gzip.NewWriter(f)
+	w := tar.NewWriter(z)
+	for _, hdr := range hdrs {
+		hdr := hdr
+		hdr.Size = int64(len(data[hdr.Name]))
+		if hdr.Mode == 0 {
+			hdr.Mode = 0644
+		}
+		if err := w.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(data[hdr.Name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSafePath(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		safe bool
+	}{
+		{"x/a/f", true},
+		{"x/a/../b/f", true},
+		{"./f", true},
+		{"..", false},
+		{"../f", false},
+		{"x/../../f", false},
+		{"/etc/passwd", false},
+		{"/x/../f", false},
+	} {
+		if got := safePath(tt.name); got != tt.safe {
+			t.Errorf("safePath(%q) = %t, want %t", tt.name, got, tt.safe)
+		}
+	}
+}
+
+// TestExtractEntryEscapes checks that no entry is written outside the current
+// directory, whether by its name, through a symlink, or as a hard link.
+func TestExtractEntryEscapes(t *testing.T) {
+	base := t.TempDir()
+	outside := filepath.Join(base, "outside")
+	work := filepath.Join(base, "work")
+	for _, dir := range []string{outside, work} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, work)
+
+	if err := os.Symlink(outside, "out"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("..", "up"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir("in", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		hdr tar.Header
+		err string
+	}{
+		{tar.Header{Name: "../f", Typeflag: tar.TypeReg}, "unsafe path"},
+		{tar.Header{Name: "x/../../f", Typeflag: tar.TypeReg}, "unsafe path"},
+		{tar.Header{Name: filepath.Join(outside, "f"), Typeflag: tar.TypeReg}, "unsafe path"},
+		{tar.Header{Name: "../l", Typeflag: tar.TypeSymlink, Linkname: "in"}, "unsafe path"},
+		{tar.Header{Name: "out/f", Typeflag: tar.TypeReg}, "path through a symlink"},
+		{tar.Header{Name: "out/new/f", Typeflag: tar.TypeReg}, "path through a symlink"},
+		{tar.Header{Name: "up/outside/f", Typeflag: tar.TypeReg}, "path through a symlink"},
+		{tar.Header{Name: "out/d", Typeflag: tar.TypeDir}, "path through a symlink"},
+		{tar.Header{Name: "l", Typeflag: tar.TypeLink, Linkname: "../outside/secret"}, "unsafe link"},
+		{tar.Header{Name: "l", Typeflag: tar.TypeLink, Linkname: filepath.Join(outside, "secret")}, "unsafe link"},
+		{tar.Header{Name: "l", Typeflag: tar.TypeLink, Linkname: "out/secret"}, "link through a symlink"},
+	} {
+		err := extractEntry(&tt.hdr, strings.NewReader(""))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("extracting %s = %v, want %q", tt.hdr.Name, err, tt.err)
+		}
+	}
+
+	entries, err := os.ReadDir(outside)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("outside directory has %d entries, want only the secret", len(entries))
+	}
+	if _, err := os.Lstat("l"); !os.IsNotExist(err) {
+		t.Errorf("rejected hard link was created: %v", err)
+	}
+}
+
+// TestExtractEntryOverSymlink checks that a regular file landing on an existing
+// symlink replaces the symlink instead of writing to its target.
+func TestExtractEntryOverSymlink(t *testing.T) {
+	base := t.TempDir()
+	secret := filepath.Join(base, "secret")
+	if err := os.WriteFile(secret, []byte("secret\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	work := filepath.Join(base, "work")
+	if err := os.Mkdir(work, 0755); err != nil {
+		t.Fatal(err)
+	}
+	chdir(t, work)
+
+	if err := os.Symlink(secret, "f"); err != nil {
+		t.Fatal(err)
+	}
+
+	hdr := tar.Header{Name: "f", Typeflag: tar.TypeReg, Mode: 0644}
+	if err := extractEntry(&hdr, strings.NewReader("data\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := os.ReadFile(secret); err != nil {
+		t.Fatal(err)
+	} else if string(b) != "secret\n" {
+		t.Errorf("symlink target was overwritten with %q", b)
+	}
+	if info, err := os.Lstat("f"); err != nil {
+		t.Fatal(err)
+	} else if !info.Mode().IsRegular() {
+		t.Errorf("f is %v, want a regular file", info.Mode())
+	}
+}
+
+// TestExtractMissingLinks checks that hard links of the selected repo to files
+// of other repos are extracted with the content of their target, without
+// extracting the other repo.
+func TestExtractMissingLinks(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+
+	name := filepath.Join(t.TempDir(), "out.tar.gz")
+	writeArchive(t, name, []tar.Header{
+		{Name: "x/b/f", Typeflag: tar.TypeReg},
+		{Name: "x/a/f", Typeflag: tar.TypeLink, Linkname: "x/b/f"},
+		{Name: "x/a/g", Typeflag: tar.TypeLink, Linkname: "x/b/f"},
+		{Name: "x/a/h", Typeflag: tar.TypeReg},
+		{Name: "x/a/s", Typeflag: tar.TypeSymlink, Linkname: "f"},
+	}, map[string]string{"x/b/f": "shared\n", "x/a/h": "own\n"})
+
+	chdir(t, t.TempDir())
+	if err := extractArchive(name, "x/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for file, want := range map[string]string{
+		"x/a/f": "shared\n", "x/a/g": "shared\n", "x/a/h": "own\n", "x/a/s": "shared\n",
+	} {
+		if b, err := os.ReadFile(filepath.FromSlash(file)); err != nil {
+			t.Error(err)
+		} else if string(b) != want {
+			t.Errorf("%s = %q, want %q", file, b, want)
+		}
+	}
+
+	f, err := os.Stat(filepath.Join("x", "a", "f"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := os.Stat(filepath.Join("x", "a", "g"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(f, g) {
+		t.Error("x/a/g is not a hard link of x/a/f")
+	}
+	if _, err := os.Stat(filepath.Join("x", "b")); !os.IsNotExist(err) {
+		t.Errorf("other repo was extracted: %v", err)
+	}
+
+	if err := extractArchive(name, "x/c"); err == nil {
+		t.Error("extracted a repo not in the archive")
+	}
+}
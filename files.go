@@ -0,0 +1,53 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "fmt"
+
+// fitWorkers lowers -download-workers when the limit on open files, even once
+// raised, is too low for every worker to clone at once, which would otherwise
+// fail clones and archiving with "too many open files".
+func fitWorkers() {
+	want := filesSpare + uint64(qWorkers+dlWorkers)*filesPerDl
+	limit := fileLimit(want)
+	if limit >= want {
+		return
+	}
+
+	n := 1
+	if fit := int(limit/filesPerDl) - filesSpare/filesPerDl - qWorkers; fit > n {
+		n = fit
+	}
+
+	if n >= dlWorkers {
+		msgs <- msg{
+			s: fmt.Sprintf("open file limit of %d is low, downloads may "+
+				"fail with too many open files", limit),
+			v: false,
+		}
+		return
+	}
+
+	msgs <- msg{
+		s: fmt.Sprintf("open file limit of %d is low, lowering download "+
+			"workers from %d to %d", limit, dlWorkers, n),
+		v: false,
+	}
+	dlWorkers = n
+}
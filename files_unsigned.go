@@ -0,0 +1,29 @@
+//go:build aix || darwin || illumos || linux || netbsd || openbsd || solaris
+// +build aix darwin illumos linux netbsd openbsd solaris
+
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import "syscall"
+
+// setSoft sets the soft limit of lim to n.
+func setSoft(lim *syscall.Rlimit, n uint64) {
+	lim.Cur = n
+}
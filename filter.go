@@ -0,0 +1,348 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// Bytes read from the start of a file to decide whether it is binary.
+const binarySniff = 8000
+
+// filter decides which repos are kept. The command line sets the default
+// filter, which each job of -jobs-file may override.
+type filter struct {
+	binRatio   float64
+	contains   string
+	exclude    []string
+	langs      map[string]bool
+	langAPI    bool
+	langBytes  int
+	maxAge     time.Duration
+	minCommits int
+	noArchived bool
+	noForks    bool
+	visibility map[string]bool
+	warnOnly   bool
+}
+
+// register defines the filter flags on fs, defaulting to the current settings
+// of f.
+func (f *filter) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.warnOnly, "filters-warn-only", f.warnOnly,
+		"report the repos the filters would skip, but download them anyway")
+	fs.StringVar(&f.contains, "contains-path", f.contains,
+		"skip repos without this path, relative to their root, on HEAD")
+	fs.Func("lang", "only download repos in these comma-separated languages",
+		func(s string) error {
+			f.langs = make(map[string]bool)
+			for _, l := range strings.Split(s, ",") {
+				if l = strings.TrimSpace(l); l != "" {
+					f.langs[strings.ToLower(l)] = true
+				}
+			}
+			if len(f.langs) == 0 {
+				return errors.New("no languages")
+			}
+			return nil
+		})
+	fs.BoolVar(&f.langAPI, "lang-api", f.langAPI,
+		"match -lang against every language of a repo, not just the primary")
+	fs.IntVar(&f.langBytes, "lang-bytes", f.langBytes,
+		"bytes of a language a repo needs for -lang-api to match it")
+	fs.DurationVar(&f.maxAge, "max-age", f.maxAge,
+		"skip repos whose last commit is older than this")
+	fs.IntVar(&f.minCommits, "min-commits", f.minCommits,
+		"skip repos with fewer commits on HEAD than this")
+	fs.BoolVar(&f.noArchived, "no-archived", f.noArchived,
+		"skip archived repos")
+	fs.BoolVar(&f.noForks, "no-forks", f.noForks, "skip forks")
+	fs.Float64Var(&f.binRatio, "skip-binary-ratio", f.binRatio,
+		"skip repos whose working tree is more than this fraction binary")
+	fs.Func("visibility", "only download repos of these comma-separated "+
+		"visibilities: public, internal, private", func(s string) error {
+		f.visibility = make(map[string]bool)
+		for _, v := range strings.Split(s, ",") {
+			switch v {
+			case "public", "internal", "private":
+				f.visibility[v] = true
+			default:
+				return fmt.Errorf("unknown visibility %s", v)
+			}
+		}
+		return nil
+	})
+	fs.Func("x", "exclude comma-separated list of repos or globs of them",
+		func(s string) error {
+			f.exclude = strings.Split(s, ",")
+			for _, x := range f.exclude {
+				if _, err := filepath.Match(x, ""); err != nil {
+					return fmt.Errorf("invalid glob %s", x)
+				}
+			}
+			return nil
+		})
+}
+
+// excluded reports whether -x names a repo, or has a glob matching it.
+func (f *filter) excluded(name string) bool {
+	for _, x := range f.exclude {
+		if ok, _ := filepath.Match(x, name); ok || x == name {
+			return true
+		}
+	}
+	return false
+}
+
+// visible reports whether a repo of a visibility is kept.
+func (f *filter) visible(name, visibility string) bool {
+	return f.visibility == nil || f.visibility[visibility] ||
+		!f.drop(name, visibility+" visibility")
+}
+
+// speaks checks a discovered repo of the given primary language against -lang,
+// before it is queued or counted. Repos it drops are reported and accounted
+// for -recheck. With -lang-api, preFilter checks every language instead.
+func (f *filter) speaks(name, language string) bool {
+	if f.langs == nil || f.langAPI || f.langs[strings.ToLower(language)] {
+		return true
+	}
+
+	reason := "language " + language
+	if language == "" {
+		reason = "no language"
+	}
+	if !f.drop(name, reason) {
+		return true
+	}
+
+	msgs <- msg{
+		s: fmt.Sprintf("skipped %s: %s", name, reason),
+		v: true,
+	}
+	account(name)
+	return false
+}
+
+// drop reports whether a repo the filter rejects for reason is dropped. With
+// -filters-warn-only, the repo is only reported and kept.
+func (f *filter) drop(name, reason string) bool {
+	if reason == "" {
+		return false
+	}
+
+	if f.warnOnly {
+		msgs <- msg{
+			s: fmt.Sprintf("would skip %s: %s", name, reason),
+			v: false,
+		}
+		return false
+	}
+
+	return true
+}
+
+// preFilter checks a repo against the filters that need the API before cloning
+// it. It returns why the repo should be dropped, or "" if it should be kept.
+func preFilter(client *github.Client, in dl) (string, error) {
+	f := in.filter
+
+	if f.noForks && in.fork {
+		return "fork", nil
+	}
+
+	if f.noArchived && in.archived {
+		return "archived", nil
+	}
+
+	// The primary language is already checked by speaks
+	if f.langs != nil && f.langAPI && !in.local {
+		langs, _, err := client.Repositories.ListLanguages(
+			context.Background(), in.login, in.name)
+		if err != nil {
+			return "", err
+		}
+
+		for l, n := range langs {
+			if f.langs[strings.ToLower(l)] && n > f.langBytes {
+				return "", nil
+			}
+		}
+		return "no matching languages", nil
+	}
+
+	return "", nil
+}
+
+// postFilter checks a clone against the filters that need its contents. It
+// returns why the clone should be dropped, or "" if it should be kept.
+func postFilter(ctx context.Context, f *filter, name, dir string) (string, error) {
+	if f.maxAge > 0 {
+		out, err := output(git(ctx, "-C", dir, "log", "-1", "--all",
+			"--format=%ct"))
+		if err != nil {
+			return "", err
+		}
+
+		if out == "" {
+			return "no commits", nil
+		}
+
+		sec, err := strconv.ParseInt(out, 10, 64)
+		if err != nil {
+			return "", err
+		}
+
+		if age := time.Since(time.Unix(sec, 0)); age > f.maxAge {
+			return fmt.Sprintf("last commit %s ago",
+				age.Truncate(time.Hour)), nil
+		}
+	}
+
+	if f.minCommits > 0 {
+		n, err := commitCount(ctx, dir)
+		if err != nil {
+			return "", err
+		}
+
+		if n < f.minCommits {
+			return fmt.Sprintf("fewer than %d commits", f.minCommits), nil
+		}
+	}
+
+	if f.binRatio > 0 {
+		ratio, err := binaryShare(dir)
+		if err != nil {
+			return "", err
+		}
+
+		if ratio > f.binRatio {
+			return fmt.Sprintf("binary ratio %.2f", ratio), nil
+		}
+
+		msgs <- msg{
+			s: fmt.Sprintf("kept %s: binary ratio %.2f", name, ratio),
+			v: true,
+		}
+	}
+
+	if f.contains != "" {
+		ok, err := containsPath(ctx, dir, f.contains)
+		if err != nil {
+			return "", err
+		}
+
+		if !ok {
+			return "no " + f.contains, nil
+		}
+
+		msgs <- msg{
+			s: fmt.Sprintf("kept %s: has %s", name, f.contains),
+			v: true,
+		}
+	}
+
+	return "", nil
+}
+
+// commitCount returns the number of commits reachable from HEAD, which is 0 for
+// an empty repo.
+func commitCount(ctx context.Context, dir string) (int, error) {
+	if err := run(git(ctx, "-C", dir, "rev-parse", "-q", "--verify",
+		"HEAD")); err != nil {
+		return 0, nil
+	}
+
+	out, err := output(git(ctx, "-C", dir, "rev-list", "--count", "HEAD"))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(out)
+}
+
+// containsPath reports whether the tree of HEAD has a file or directory at
+// path, which also works for clones without a working tree.
+func containsPath(ctx context.Context, dir, path string) (bool, error) {
+	if err := run(git(ctx, "-C", dir, "rev-parse", "-q", "--verify",
+		"HEAD")); err != nil {
+		return false, nil
+	}
+
+	out, err := output(git(ctx, "-C", dir, "ls-tree", "--name-only", "HEAD",
+		"--", strings.Trim(filepath.ToSlash(path), "/")))
+	return out != "", err
+}
+
+// binaryShare returns the fraction of bytes in a working tree belonging to
+// binary files, which are detected like git does, by a NUL byte near the
+// start.
+func binaryShare(dir string) (float64, error) {
+	var binary, total int64
+	buf := make([]byte, binarySniff)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		total += info.Size()
+		if bytes.IndexByte(buf[:n], 0) != -1 {
+			binary += info.Size()
+		}
+		return nil
+	})
+
+	if err != nil || total == 0 {
+		return 0, err
+	}
+
+	return float64(binary) / float64(total), nil
+}
@@ -26,15 +26,17 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
-	"syscall"
 	"time"
 
 	"github.com/google/go-github/github"
 	"golang.org/x/oauth2"
-	"golang.org/x/term"
 )
 
 type msg struct {
@@ -43,62 +45,643 @@ type msg struct {
 }
 
 const (
-	defaultTimeout = 10 * time.Minute
-	dlBacklog      = 100
-	sleep          = time.Second
-	workers        = 10
+	blockSize         = 512
+	branchDir         = "branches"
+	defaultMaxWait    = time.Hour
+	defaultSleep      = time.Second
+	defaultTimeout    = 10 * time.Minute
+	defaultTokenEvery = 50 * time.Minute
+	dlBacklog         = 10
+	filesPerDl        = 8
+	filesSpare        = 64
+	maxRate           = 1000
+	maxRetries        = 100
+	maxRetryWait      = 5 * time.Minute
+	minRate           = 1.0 / (24 * 60 * 60)
+	noTopic           = "_none"
+	pageWorkers       = 4
+	pgzipBlock        = 1 << 20
+	ramDir            = "/dev/shm"
+	releaseDir        = "releases"
+	retryWait         = 2 * time.Second
+	searchRetries     = 3
+	stderrMax         = 4096
+	subJobs           = 16
+	storeMin          = 64 << 10
+	tagDir            = "tags"
+	tagContext        = 24 * time.Hour
+	workers           = 10
 )
 
 var (
 	// Flags
+	allWorkers int
+	dlWorkers  int
+	qWorkers   int
+	rate       float64
+	interval   time.Duration
+	allowEmpty bool
+	allBranch  bool
+	anonPublic bool
+	annexOn    bool
+	api        string
 	auth       bool
+	bandwidth  int64
+	bestEffort bool
+	blocking   int
+	bundles    bool
+	byCreated  bool
+	catalog    bool
+	check      bool
+	checkpoint int
+	compact    bool
+	dedup      bool
+	delta      string
+	depth      int
+	estimate   bool
+	force      bool
+	extract    string
+	follow     bool
+	gitConfig  configList
+	gitJobs    int
+	gzThreads  int
+	isolate    bool
+	jobsFile   string
 	level      int
+	logFile    string
+	lowSpeed   int64
+	lowTime    time.Duration
+	noCheckout bool
+	outNames   []string
+	ownerKind  string
+	pipeline   bool
+	manifest   string
+	mirror     bool
+	maxWait    time.Duration
+	volumeSize int64
+	orgMeta    bool
+	parents    bool
+	pax        bool
+	progress   bool
+	protocol   string
+	httpsToken bool
+	onlyRepo   string
+	pruneEmpty bool
+	pushTo     string
+	privGists  bool
+	gistsOn    bool
+	prs        bool
+	issues     bool
 	quiet      bool
+	ramClone   bool
+	recheck    bool
+	retain     int
+	retries    int
+	settingsOn bool
+	metaOn     bool
+	releases   bool
+	sinceTag   bool
+	smart      bool
+	socks5     string
+	stateFile  string
 	submodules bool
+	subErrs    bool
+	subSkip    string
+	tagCount   int
+	throttle   bool
 	timeout    time.Duration
+	tokenCmd   string
+	topicsOn   bool
+	tokenEvery time.Duration
+	tokenFile  string
+	tokensFile string
+	treeOn     bool
+	updateOnly bool
 	verbose    bool
-	exclude    string
+	verifyArc  bool
+	webhook    string
+	workDir    string
 
-	// Authentication token
-	password string
+	// Normalized archive permissions, or -1 to keep the original ones
+	perm int64 = -1
 
-	// Excluded repos
-	excluded map[string]bool
+	// Fixed ownership of files in the archive, or nil to keep the original one
+	tarOwner *owner
+
+	// Filter of repos named on the command line
+	defaults filter
+
+	// Archive written while downloading, with -pipeline
+	pipe *archiver
+
+	// Source of the access token, if any, for -https clones
+	tokenSrc oauth2.TokenSource
+
+	// Host serving clones, with -https given the token
+	gitHost string
+
+	// Whether API requests carry a token
+	authed bool
+
+	// Where the user set their own ssh command for git, if anywhere
+	ownSSH string
+
+	// Empty home directory for isolated git commands
+	home string
 
 	// Stat counters
 	successful uint64
 	total      uint64
+	estimated  uint64
+	empty      uint64
+	unchanged  uint64
 
 	// Output stream
 	msgs chan interface{}
 )
 
 func main() {
-	name := fmt.Sprintf("gh-dl-%d.tar.gz", time.Now().UTC().Unix())
+	now := time.Now().UTC()
+	names := []string{defaultName(now)}
 
 	log.SetFlags(0)
 	log.SetPrefix("error: ")
 
 	flag.BoolVar(&auth, "a", false,
 		`enter personal authentication token (uses ssh for cloning private repos)`)
+	flag.IntVar(&blocking, "tar-blocking-factor", 0,
+		"write the archive in records of this many 512-byte blocks")
+	flag.BoolVar(&byCreated, "by-created", false,
+		"order repos in the archive and manifest by their creation date")
+	flag.BoolVar(&catalog, "catalog", false,
+		"save only the README and metadata of each repo, without cloning")
+	flag.BoolVar(&check, "check", false,
+		"check that every name exists before downloading anything")
+	flag.IntVar(&checkpoint, "checkpoint", 0,
+		"sync the archive to disk after adding every this many repos")
+	flag.Var(&gitConfig, "c",
+		"set git configuration key=value for every git command, repeatable")
+	flag.BoolVar(&compact, "compact", false,
+		"prune and aggressively repack each clone before archiving")
+	flag.BoolVar(&dedup, "dedup", false,
+		"store identical files once, as hard links to the first")
+	flag.IntVar(&depth, "d", 0,
+		"shallow clone only the default branch, to this many commits")
+	flag.StringVar(&delta, "delta", "",
+		"only download repos whose HEAD differs from this manifest")
+	flag.IntVar(&dlWorkers, "download-workers", workers,
+		"number of concurrent git clones")
+	flag.BoolVar(&anonPublic, "anon-public", false,
+		"clone public repos without credentials")
+	flag.BoolVar(&annexOn, "annex", false,
+		"add the archive to a git-annex repo in its directory")
+	flag.StringVar(&api, "api", "", "GitHub API base URL")
+	flag.BoolVar(&bestEffort, "archive-best-effort", false,
+		"report and skip files that cannot be read instead of failing the archive")
+	flag.BoolVar(&allBranch, "all-branches-checkout", false,
+		"check out the working tree of every branch into branches/<branch>")
+	flag.BoolVar(&allowEmpty, "allow-empty", false,
+		"exit successfully without an archive if no repos were downloaded")
+	flag.BoolVar(&bundles, "delta-bundles", false,
+		"with -delta, archive changed repos as bundles of only their new commits")
+	flag.BoolVar(&estimate, "estimate", false,
+		"print the estimated size of the repos instead of downloading them")
+	flag.StringVar(&extract, "extract", "",
+		"extract this archive into the current directory instead of downloading")
+	flag.BoolVar(&force, "f", false,
+		"overwrite an archive that already exists")
+	flag.BoolVar(&follow, "follow", false,
+		"archive renamed or transferred repos under their current owner")
+	flag.IntVar(&gitJobs, "git-jobs", 0,
+		"number of parallel fetches within each clone, 0 for git's defaults")
+	flag.BoolVar(&gistsOn, "gists", false,
+		"also download the gists of each user, secret ones only with a token")
+	flag.IntVar(&gzThreads, "gzip-threads", 1,
+		"number of threads compressing the archive in parallel")
+	flag.BoolVar(&issues, "issues", false,
+		"save the issues and pull requests of each repo as issues.json")
+	flag.BoolVar(&isolate, "isolate", false,
+		"run git without the host's git configuration and credential helpers")
+	flag.StringVar(&jobsFile, "jobs-file", "",
+		"also download the names of the jobs in this JSON file")
+	flag.IntVar(&allWorkers, "j", workers,
+		"number of concurrent API queries and git clones")
 	flag.IntVar(&level, "l", gzip.DefaultCompression, "gzip compression level")
+	flag.IntVar(&qWorkers, "query-workers", workers,
+		"number of concurrent API queries")
+	flag.Func("low-speed-limit", "abort git transfers slower than this "+
+		"many bytes per second for -low-speed-time", func(s string) (err error) {
+		lowSpeed, err = parseSize(s)
+		return err
+	})
+	flag.DurationVar(&lowTime, "low-speed-time", 0,
+		"how long git transfers may be slower than -low-speed-limit")
+	flag.StringVar(&ownerKind, "k", "auto",
+		`kind of the owners named: "user", "org", or "auto" to look it up`)
+	flag.StringVar(&logFile, "log", "",
+		"append every message, including verbose ones, to this file")
+	flag.Func("o", "archive name, with {date}, {time}, {owner}, {count}, and "+
+		"{host} replaced; repeat to write the archive to several places",
+		func(s string) error {
+			outNames = append(outNames, s)
+			return nil
+		})
+	flag.BoolVar(&mirror, "mirror", false,
+		"clone bare mirrors with every ref instead of working trees")
+	flag.BoolVar(&noCheckout, "no-checkout", false,
+		"clone without checking out a working tree")
+	flag.StringVar(&manifest, "manifest", "",
+		"write the HEAD commit of every repo to this manifest")
+	flag.DurationVar(&maxWait, "max-wait", defaultMaxWait,
+		"longest to wait for the API rate limit to reset, 0 to never wait")
+	flag.BoolVar(&metaOn, "metadata", false,
+		"save the discovered details of each repo as metadata.json")
+	flag.BoolVar(&orgMeta, "org-meta", false,
+		"save teams and members of organizations")
+	flag.Func("owner", "UID:GID, optionally followed by :USER:GROUP, to own "+
+		"files in the archive", func(s string) (err error) {
+		tarOwner, err = parseOwner(s)
+		return
+	})
+	flag.Func("perm", "octal permissions of files in the archive",
+		func(s string) error {
+			m, err := strconv.ParseUint(s, 8, 32)
+			if err != nil || m > 0777 {
+				return errors.New("invalid mode")
+			}
+			perm = int64(m)
+			return nil
+		})
+	flag.BoolVar(&pipeline, "pipeline", false,
+		"archive and delete each repo as soon as it is cloned")
+	flag.BoolVar(&pax, "pax", false,
+		"record the clone URL and HEAD of each repo in PAX headers")
+	flag.BoolVar(&progress, "progress", false,
+		"print when each clone starts and finishes (implies -v)")
+	flag.BoolVar(&privGists, "private-gists", false,
+		"also download the secret gists of the authenticated user")
+	flag.BoolVar(&prs, "prs", false,
+		"save the pull requests of each repo as pulls.json")
+	flag.BoolVar(&httpsToken, "https", false,
+		"clone private repos over https with the access token instead of ssh")
+	flag.StringVar(&protocol, "protocol", "",
+		`clone every repo over "https", "ssh", or "git"`)
+	flag.DurationVar(&interval, "sleep", defaultSleep,
+		"time each worker waits between requests without -rate")
+	flag.Float64Var(&rate, "rate", 0,
+		"limit API requests and clone starts to this many per second")
+	flag.Func("rate-limit", "limit each clone connection to this many bytes "+
+		"per second", func(s string) (err error) {
+		bandwidth, err = parseSize(s)
+		return err
+	})
+	flag.BoolVar(&pruneEmpty, "prune-empty", false,
+		"drop repos without commits and users without repos")
+	flag.StringVar(&pushTo, "push-to", "",
+		"also push each repo to this URL, with {owner} and {repo} replaced")
 	flag.BoolVar(&quiet, "q", false, "quiet except for fatal errors")
+	flag.StringVar(&onlyRepo, "repo", "",
+		"with -extract, extract only this owner/repo")
+	flag.BoolVar(&ramClone, "ram-clone", false,
+		"clone into memory-backed storage, in "+ramDir)
+	flag.BoolVar(&recheck, "recheck", false,
+		"query the API again after downloading and report missing repos")
+	flag.IntVar(&retries, "r", 2,
+		"times to retry a failed clone, waiting twice as long each time")
+	flag.IntVar(&retain, "retain", 0,
+		"keep only this many of the newest archives")
+	flag.BoolVar(&subErrs, "ignore-submodule-errors", false,
+		"keep repos whose submodules cannot all be fetched")
+	flag.BoolVar(&releases, "releases", false,
+		"download the release assets of each repo into releases/<tag>")
+	flag.BoolVar(&settingsOn, "settings", false,
+		"save the settings and branch protection of each repo")
+	flag.BoolVar(&sinceTag, "since-last-tag", false,
+		"shallow clone only the history since the latest tag")
+	flag.BoolVar(&smart, "smart-compress", false,
+		"store already compressed files, such as git packs, uncompressed")
+	flag.StringVar(&socks5, "socks5", "",
+		"send API requests and clones through this SOCKS5 proxy host:port")
+	flag.StringVar(&stateFile, "state", "",
+		"save discovery progress to this file and resume from it")
 	flag.BoolVar(&submodules, "s", false, "recursively fetch submodules")
+	flag.StringVar(&subSkip, "submodule-exclude", "",
+		"with -s, do not fetch submodules whose path matches this glob")
+	flag.IntVar(&tagCount, "tags", 0,
+		"also shallow clone each of the latest this many tags into tags/<tag>")
+	flag.BoolVar(&throttle, "throttle-on-error", false,
+		"pause all API requests when GitHub asks to retry later")
 	flag.DurationVar(&timeout, "t", defaultTimeout,
 		`git clone timeout duration, "0s" for none`)
+	flag.StringVar(&tokenCmd, "token-cmd", "",
+		"shell command printing an access token, rerun to refresh it")
+	flag.DurationVar(&tokenEvery, "token-refresh", defaultTokenEvery,
+		"how long a token from -token-cmd is used before refreshing it")
+	flag.BoolVar(&topicsOn, "topics", false,
+		"archive repos under topics/<topic>/ by their first topic")
+	flag.BoolVar(&updateOnly, "update-only", false,
+		"only update repos already in the work directory")
+	flag.Func("volume-size", "split the archive into volumes of this size",
+		func(s string) (err error) {
+			volumeSize, err = parseSize(s)
+			return err
+		})
+	flag.StringVar(&tokenFile, "token-file", "",
+		"file holding the access token")
+	flag.StringVar(&tokensFile, "tokens-file", "",
+		"file of access tokens, one per line, used in turn")
+	flag.BoolVar(&treeOn, "tree", false,
+		"add tree.txt, listing each repo's size and top-level contents")
 	flag.BoolVar(&verbose, "v", false, "print more details")
-	flag.StringVar(&exclude, "x", "", "exclude comma-separated list of repos")
+	flag.BoolVar(&parents, "with-parents", false,
+		"also download the parents of forks")
+	flag.BoolVar(&verifyArc, "verify-archive", false,
+		"read back the archive after writing it")
+	flag.StringVar(&webhook, "webhook", "",
+		"POST a JSON summary of the run to this URL when it finishes")
+	flag.StringVar(&workDir, "work-dir", "",
+		"clone into this directory and keep the clones after archiving")
+	defaults.register(flag.CommandLine)
 	flag.Parse()
 
+	if progress {
+		verbose = true
+	}
+
 	if quiet && verbose {
 		log.Fatal("quiet and verbose flags are mutually exclusive")
 	}
 
-	if flag.NArg() == 0 {
+	if onlyRepo != "" && extract == "" {
+		log.Fatal("-repo requires -extract")
+	}
+
+	if extract != "" {
+		if flag.NArg() > 0 {
+			log.Fatal("-extract takes no names")
+		}
+		if err := extractArchive(extract, strings.Trim(onlyRepo, "/")); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	sources := 0
+	for _, set := range []bool{auth, tokenCmd != "", tokenFile != "",
+		tokensFile != ""} {
+		if set {
+			sources++
+		}
+	}
+
+	if sources > 1 {
+		log.Fatal("-a, -token-cmd, -token-file, and -tokens-file are " +
+			"mutually exclusive")
+	}
+
+	switch protocol {
+	case "", "https", "ssh", "git":
+	default:
+		log.Fatal("protocol must be https, ssh, or git")
+	}
+
+	if httpsToken && protocol != "" && protocol != "https" {
+		log.Fatal("-https only combines with -protocol https")
+	}
+
+	switch ownerKind {
+	case "user", "org", "auto":
+	default:
+		log.Fatal("owner kind must be user, org, or auto")
+	}
+
+	if privGists {
+		if sources == 0 && os.Getenv(tokenEnv) == "" {
+			log.Fatal("-private-gists requires a token")
+		}
+		if catalog {
+			log.Fatal("-private-gists and -catalog are mutually exclusive")
+		}
+	}
+
+	if gistsOn && catalog {
+		log.Fatal("-gists and -catalog are mutually exclusive")
+	}
+
+	if mirror {
+		switch {
+		case submodules:
+			log.Fatal("-mirror and -s are mutually exclusive")
+		case allBranch:
+			log.Fatal("-mirror and -all-branches-checkout are mutually exclusive")
+		case tagCount > 0:
+			log.Fatal("-mirror and -tags are mutually exclusive")
+		case defaults.binRatio > 0:
+			log.Fatal("-mirror and -skip-binary-ratio are mutually exclusive")
+		}
+	}
+
+	if noCheckout {
+		switch {
+		case allBranch:
+			log.Fatal("-no-checkout and -all-branches-checkout are mutually exclusive")
+		case tagCount > 0:
+			log.Fatal("-no-checkout and -tags are mutually exclusive")
+		case defaults.binRatio > 0:
+			log.Fatal("-no-checkout and -skip-binary-ratio are mutually exclusive")
+		}
+	}
+
+	if subSkip != "" {
+		if !submodules {
+			log.Fatal("-submodule-exclude requires -s")
+		}
+		if _, err := filepath.Match(subSkip, ""); err != nil {
+			log.Fatal("invalid -submodule-exclude glob")
+		}
+	}
+
+	if bandwidth > 0 && socks5 != "" {
+		log.Fatal("-rate-limit and -socks5 are mutually exclusive")
+	}
+
+	// The git protocol cannot be proxied
+	if protocol == "git" && (socks5 != "" || bandwidth > 0) {
+		log.Fatal("-protocol git cannot go through -socks5 or -rate-limit")
+	}
+
+	if bundles {
+		if delta == "" {
+			log.Fatal("-delta-bundles requires -delta")
+		}
+		if workDir != "" {
+			log.Fatal("-delta-bundles and -work-dir are mutually exclusive")
+		}
+	}
+
+	if updateOnly && workDir == "" {
+		log.Fatal("-update-only requires -work-dir")
+	}
+
+	// Repos of the pages already discovered are only kept in the work directory
+	if stateFile != "" && workDir == "" {
+		log.Fatal("-state requires -work-dir")
+	}
+
+	if ramClone && workDir != "" {
+		log.Fatal("-ram-clone and -work-dir are mutually exclusive")
+	}
+
+	if pipeline && workDir != "" {
+		log.Fatal("-pipeline and -work-dir are mutually exclusive")
+	}
+
+	if retries < 0 || retries > maxRetries {
+		log.Fatalf("clone retry count must be between 0 and %d", maxRetries)
+	}
+
+	if retain < 0 {
+		log.Fatal("retained archive count must not be negative")
+	}
+
+	if blocking < 0 {
+		log.Fatal("tar blocking factor must not be negative")
+	}
+
+	if tagCount < 0 {
+		log.Fatal("tag count must not be negative")
+	}
+
+	if depth < 0 {
+		log.Fatal("clone depth must not be negative")
+	}
+
+	if depth > 0 && sinceTag {
+		log.Fatal("-d and -since-last-tag are mutually exclusive")
+	}
+
+	// Tags are only ordered by date through GraphQL, which requires a token
+	if sources == 0 && os.Getenv(tokenEnv) == "" {
+		if sinceTag {
+			log.Fatal("-since-last-tag requires a token")
+		}
+		if tagCount > 0 {
+			log.Fatal("-tags requires a token")
+		}
+	}
+
+	if depth > 0 && allBranch {
+		log.Fatal("-d and -all-branches-checkout are mutually exclusive")
+	}
+
+	if checkpoint < 0 {
+		log.Fatal("checkpoint interval must not be negative")
+	}
+
+	if checkpoint > 0 && blocking > 0 {
+		log.Fatal("-checkpoint and -tar-blocking-factor are mutually exclusive")
+	}
+
+	if gitJobs < 0 {
+		log.Fatal("git job count must not be negative")
+	}
+
+	if gzThreads < 1 {
+		log.Fatal("gzip thread count must be at least 1")
+	}
+
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	if !explicit["download-workers"] {
+		dlWorkers = allWorkers
+	}
+	if !explicit["query-workers"] {
+		qWorkers = allWorkers
+	}
+
+	if allWorkers < 1 || dlWorkers < 1 || qWorkers < 1 {
+		log.Fatal("worker counts must be at least 1")
+	}
+
+	if interval < 0 {
+		log.Fatal("sleep time must not be negative")
+	}
+
+	// Also rejects NaN
+	if rate != 0 && !(rate >= minRate && rate <= maxRate) {
+		log.Fatalf("-rate must be between one a day and %d per second",
+			maxRate)
+	}
+
+	ownSSH = userSSH()
+
+	// An ssh command of the user's own would go around the proxy. Without
+	// -protocol https, any clone may fall back to ssh.
+	if socks5 != "" && ownSSH != "" && protocol != "https" {
+		log.Fatalf("-socks5 cannot proxy the ssh command set by %s without "+
+			"-protocol https", ownSSH)
+	}
+
+	var targets []target
+	for _, arg := range flag.Args() {
+		targets = append(targets, target{name: arg, filter: &defaults})
+	}
+
+	if jobsFile != "" {
+		jobs, err := readJobs(jobsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		targets = append(targets, jobs...)
+	}
+
+	if len(targets) == 0 && !privGists {
 		log.Fatal("no names specified")
 	}
 
-	base, err := ioutil.TempDir("", "gh-dl-")
+	invalid := 0
+	for _, t := range targets {
+		if err := validName(t.name); err != nil {
+			log.Println(err)
+			invalid++
+		}
+	}
+
+	if invalid > 0 {
+		log.Fatalf("%d invalid names", invalid)
+	}
+
+	if !estimate {
+		if err := checkNames(now, targets); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if stateFile != "" {
+		if err := readState(stateFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if delta != "" {
+		var err error
+		if prev, err = readManifest(delta); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var base string
+	var err error
+	if workDir != "" {
+		base = workDir
+		err = os.MkdirAll(base, 0700)
+	} else if ramClone {
+		base, err = ioutil.TempDir(ramDir, "gh-dl-")
+	} else {
+		base, err = ioutil.TempDir("", "gh-dl-")
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -107,17 +690,35 @@ func main() {
 		fmt.Println("working directory", base)
 	}
 
-	excluded = make(map[string]bool)
-	ex := strings.Split(exclude, ",")
-	for _, x := range ex {
-		excluded[x] = true
+	if isolate {
+		if home, err = ioutil.TempDir("", "gh-dl-home-"); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var logf *os.File
+	if logFile != "" {
+		logf, err = os.OpenFile(logFile,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
 	msgs = make(chan interface{})
-	defer close(msgs)
+	printed := make(chan struct{})
 
 	go func() {
+		defer close(printed)
 		for m := range msgs {
+			if logf != nil {
+				logMsg(logf, m)
+			}
+
+			if err, ok := m.(error); ok {
+				failures = append(failures, err.Error())
+			}
+
 			if quiet {
 				continue
 			}
@@ -133,86 +734,385 @@ func main() {
 		}
 	}()
 
-	var client *github.Client
-	if auth {
-		fmt.Print("Personal access token: ")
-		bytepass, err := term.ReadPassword(int(syscall.Stdin))
-		if err != nil {
-			log.Fatal(err)
+	// Declared ahead of the gotos below, which let failures reach the webhook
+	var (
+		hc      *http.Client
+		ctx     context.Context
+		ts      oauth2.TokenSource
+		client  *github.Client
+		queries chan query
+		dls     chan dl
+		wg      sync.WaitGroup
+	)
+
+	// The archiver reports through msgs, so it starts after the printer
+	if pipeline {
+		if len(outNames) > 0 {
+			names = partNames(now, targets)
+		}
+		if pipe, err = newArchiver(names); err != nil {
+			goto out
+		}
+	}
+
+	if rate > 0 {
+		startBucket(rate)
+	}
+
+	if bandwidth > 0 {
+		if err = startLimiter(); err != nil {
+			goto abort
+		}
+	}
+
+	hc = httpClient()
+	ctx = context.WithValue(context.Background(), oauth2.HTTPClient, hc)
+
+	if tokenCmd != "" {
+		ts = oauth2.ReuseTokenSource(nil, cmdTokenSource{
+			cmd:   tokenCmd,
+			every: tokenEvery,
+		})
+	} else if tokensFile != "" {
+		if ts, err = readTokens(tokensFile); err != nil {
+			goto abort
+		}
+	} else if auth || tokenFile != "" || os.Getenv(tokenEnv) != "" {
+		if ts, err = staticToken(); err != nil {
+			goto abort
 		}
-		password = string(bytepass)
-		fmt.Println()
-		ctx := context.Background()
-		oauth := oauth2.NewClient(ctx, oauth2.StaticTokenSource(&oauth2.Token{
-			AccessToken: password,
-		}))
-		client = github.NewClient(oauth)
-	} else {
-		client = github.NewClient(nil)
 	}
+
+	if r, ok := ts.(*rotatingTokenSource); ok {
+		hc.Transport = r.transport(hc.Transport)
+	} else if ts != nil {
+		hc = oauth2.NewClient(ctx, ts)
+	}
+	if ts != nil {
+		authed = true
+		tokenSrc = ts
+	}
+
+	client = github.NewClient(hc)
 	client.UserAgent = "gh-dl"
 
-	queries := make(chan query, flag.NArg())
-	dls := make(chan dl, dlBacklog)
-	var wg sync.WaitGroup
-	for i := 0; i < workers; i++ {
+	if api != "" {
+		var u *url.URL
+		if u, err = url.Parse(strings.TrimSuffix(api, "/") + "/"); err != nil {
+			goto abort
+		}
+		client.BaseURL = u
+	}
+
+	// GitHub serves its API from a subdomain of the host serving clones
+	gitHost = strings.TrimPrefix(client.BaseURL.Hostname(), "api.")
+
+	if check {
+		missing := 0
+		for _, t := range targets {
+			if err := checkExists(client, t.name); err != nil {
+				log.Println(err)
+				missing++
+			}
+		}
+
+		if missing > 0 {
+			err = fmt.Errorf("%d names cannot be downloaded", missing)
+			goto abort
+		}
+	}
+
+	fitWorkers()
+
+	queries = make(chan query, len(targets))
+	dls = make(chan dl, dlBacklog*dlWorkers)
+	for i := 0; i < qWorkers; i++ {
 		go consumeQueries(client, base, queries, dls, &wg)
-		go consumeDls(base, dls, &wg)
+	}
+	for i := 0; i < dlWorkers; i++ {
+		go consumeDls(client, base, dls, &wg)
 	}
 
-	wg.Add(flag.NArg())
-	for _, arg := range flag.Args() {
-		split := strings.Split(arg, "/")
+	wg.Add(len(targets))
+	for _, t := range targets {
+		if isLocal(t.name) {
+			queries <- query{
+				kind:   queryLocal,
+				owner:  localOwner,
+				repo:   t.name,
+				filter: t.filter,
+			}
+			continue
+		}
+
+		if isList(t.name) {
+			split := strings.Split(strings.TrimPrefix(t.name, listPrefix), "/")
+			queries <- query{
+				kind:   queryList,
+				owner:  split[0],
+				repo:   split[1],
+				filter: t.filter,
+			}
+			continue
+		}
+
+		if isStars(t.name) {
+			queries <- query{
+				kind:   queryStars,
+				owner:  strings.TrimPrefix(t.name, starsPrefix),
+				filter: t.filter,
+			}
+			continue
+		}
+
+		split := strings.Split(t.name, "/")
 		switch len(split) {
 		case 1:
 			queries <- query{
-				kind:  queryUser,
-				owner: arg,
+				kind:   queryUser,
+				owner:  t.name,
+				filter: t.filter,
 			}
 		case 2:
-			queries <- query{
-				kind:  queryRepo,
-				owner: split[0],
-				repo:  split[1],
+			if split[1] == "" {
+				queries <- query{
+					kind:   queryUser,
+					owner:  split[0],
+					filter: t.filter,
+					orgs:   true,
+				}
+				continue
+			}
+
+			q := query{
+				kind:   queryRepo,
+				owner:  split[0],
+				repo:   split[1],
+				filter: t.filter,
 			}
+			if at := strings.SplitN(q.repo, "@", 2); len(at) == 2 {
+				q.repo = at[0]
+				q.branches = strings.Split(at[1], ",")
+			}
+			queries <- q
 		default:
-			msgs <- fmt.Errorf("arg %s invalid", arg)
+			msgs <- fmt.Errorf("arg %s invalid", t.name)
 			wg.Done()
 		}
 	}
 
+	if privGists {
+		wg.Add(1)
+		go discoverGists(client, base, &defaults, dls, &wg)
+	}
+
 	wg.Wait()
 	close(queries)
 	close(dls)
 
+	if estimate {
+		msgs <- msg{
+			s: fmt.Sprintf("estimated size of %d repos: %s (git size, clones "+
+				"may differ)", total, formatSize(estimated)),
+			v: false,
+		}
+		goto out
+	}
+
 	msgs <- msg{
-		s: fmt.Sprintf("downloaded %d/%d repos", successful, total),
+		s: summary(),
 		v: false,
 	}
 
+	if recheck {
+		msgs <- msg{
+			s: fmt.Sprintf("rechecked, %d repos missing",
+				recheckRepos(client, targets)),
+			v: false,
+		}
+	}
+
 	if successful == 0 {
-		err = errors.New("failed to download any repos")
-		goto out
+		// An incremental run finding nothing new still updates the manifest
+		if unchanged > 0 {
+			msgs <- msg{
+				s: "no repos changed, not creating an archive",
+				v: false,
+			}
+		} else if allowEmpty {
+			msgs <- msg{
+				s: "no repos downloaded, not creating an archive",
+				v: false,
+			}
+		} else {
+			err = errors.New("failed to download any repos")
+		}
+		goto abort
+	}
+
+	err = finish(base, names, finalNames(names, now, targets))
+	goto out
+
+abort:
+	if pipe != nil {
+		pipe.abort()
+	}
+
+out:
+	if err == nil && manifest != "" && !estimate {
+		err = writeManifest(manifest)
+	}
+
+	if workDir == "" {
+		if err2 := os.RemoveAll(base); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+
+	if home != "" {
+		if err2 := os.RemoveAll(home); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+
+	// Print everything sent before exiting
+	close(msgs)
+	<-printed
+
+	if webhook != "" {
+		if err2 := notify(webhook, now, err); err2 != nil {
+			log.Println("webhook:", err2)
+		}
 	}
 
+	if err != nil {
+		if logf != nil {
+			logMsg(logf, err)
+		}
+		log.Fatal(err)
+	}
+}
+
+// summary describes how many repos were downloaded.
+func summary() string {
+	s := fmt.Sprintf("downloaded %d/%d repos", successful, total)
+	if empty > 0 {
+		s += fmt.Sprintf(", dropped %d empty", empty)
+	}
+	if unchanged > 0 {
+		s += fmt.Sprintf(", %d unchanged", unchanged)
+	}
+	return s
+}
+
+// logMsg appends a message to the -log file, along with when it was sent.
+func logMsg(f *os.File, m interface{}) {
+	t := time.Now().Format(time.RFC3339)
+
+	switch m := m.(type) {
+	case msg:
+		fmt.Fprintln(f, t, m.s)
+	case error:
+		fmt.Fprintln(f, t, "error:", m)
+	}
+}
+
+// finish writes the archive to every destination, or completes the -pipeline
+// archive.
+func finish(base string, names, finals []string) error {
 	msgs <- msg{
 		s: "archiving...",
 		v: true,
 	}
 
-	if err = archive(base, name); err == nil {
+	var files [][]string
+	var sum string
+	var err error
+
+	for i, final := range finals {
+		// The -pipeline archive is already written under its final name
+		if pipe != nil && final == names[i] {
+			continue
+		}
+		if err := checkNew(final); err != nil {
+			if pipe != nil {
+				pipe.abort()
+			}
+			return err
+		}
+	}
+
+	if pipe == nil {
+		files, sum, err = archive(base, finals)
+	} else if err = pipe.addAll(base); err != nil {
+		pipe.abort()
+	} else if err = pipe.close(); err == nil {
+		files, sum = pipe.files(), pipe.sum()
+		for i := range files {
+			if files[i] != nil && finals[i] != names[i] {
+				if files[i], err = renameArchive(files[i], names[i],
+					finals[i]); err != nil {
+					break
+				}
+			}
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	archived, archiveSum = nil, sum
+
+	for i, f := range files {
+		if f == nil {
+			continue
+		}
+		if err := complete(finals[i], f); err != nil {
+			return err
+		}
+		archived = append(archived, f...)
+	}
+
+	return nil
+}
+
+// complete verifies, reports, rotates, and annexes the archive name written to
+// files.
+func complete(name string, files []string) error {
+	if verifyArc {
+		msgs <- msg{
+			s: "verifying archive...",
+			v: true,
+		}
+
+		if err := verify(files); err != nil {
+			return fmt.Errorf("archive %s is unreadable: %v", name, err)
+		}
+	}
+
+	if len(files) > 1 {
+		msgs <- msg{
+			s: fmt.Sprintf("archive created: %s (%d volumes)", name, len(files)),
+			v: false,
+		}
+	} else {
 		msgs <- msg{
 			s: fmt.Sprintf("archive created: %s", name),
 			v: false,
 		}
 	}
 
-out:
-	if err2 := os.RemoveAll(base); err2 != nil && err == nil {
-		err = err2
+	var removed []string
+	if retain > 0 {
+		var err error
+		if removed, err = rotate(filepath.Dir(name), retain); err != nil {
+			return err
+		}
 	}
 
-	if err != nil {
-		log.Fatal(err)
+	if annexOn {
+		return annex(files, removed)
 	}
+
+	return nil
 }
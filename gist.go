@@ -0,0 +1,177 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/go-github/github"
+)
+
+// Directory of each owner's gists. The "@" keeps it apart from repos, whose
+// names cannot contain one.
+const gistDir = "@gists"
+
+// discoverGists queues the secret gists of the authenticated user, as
+// OWNER/@gists/ID, excluding those f excludes.
+func discoverGists(client *github.Client, base string, f *filter, out chan<- dl, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	count, err := queueGists(client, base, "", "", false, gistFilter(f), out, wg)
+	if err != nil {
+		msgs <- fmt.Errorf("gists: %v", err)
+	}
+
+	msgs <- msg{
+		s: fmt.Sprintf("found %d private gists", count),
+		v: false,
+	}
+	atomic.AddUint64(&total, count)
+}
+
+// discoverUserGists queues the public gists of a user and, when authenticated,
+// those of its secret gists the token can see, as USER/@gists/ID, excluding those
+// f excludes.
+func discoverUserGists(client *github.Client, base, user string, f *filter, out chan<- dl, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	f = gistFilter(f)
+	count, err := queueGists(client, base, user, "", true, f, out, wg)
+	if err != nil {
+		msgs <- fmt.Errorf("%s: gists: %v", user, err)
+	}
+
+	if authed {
+		secret, err := queueGists(client, base, "", user, false, f, out, wg)
+		if err != nil {
+			msgs <- fmt.Errorf("%s: secret gists: %v", user, err)
+		}
+		count += secret
+	}
+
+	msgs <- msg{
+		s: fmt.Sprintf("found %d gists for %s", count, user),
+		v: false,
+	}
+	atomic.AddUint64(&total, count)
+}
+
+// queueGists queues the gists listed for user, or for the authenticated user
+// if empty, that are public or secret as asked and, unless owner is empty,
+// owned by owner, filtered by f. It returns the number queued, which the caller
+// adds to the total, even if listing them failed partway.
+func queueGists(client *github.Client, base, user, owner string, public bool, f *filter, out chan<- dl, wg *sync.WaitGroup) (uint64, error) {
+	ctx := context.Background()
+	opt := &github.GistListOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	var count uint64
+	for {
+		gists, resp, err := client.Gists.List(ctx, user, opt)
+		if err != nil {
+			return count, err
+		}
+
+		for _, g := range gists {
+			if g.GetPublic() != public {
+				continue
+			}
+			if owner != "" && !strings.EqualFold(g.GetOwner().GetLogin(), owner) {
+				continue
+			}
+
+			d := newGistDl(g, f)
+			if !queue(d.fullname) {
+				continue
+			}
+
+			if err := mkdirs(base, d.owner); err != nil {
+				msgs <- err
+				continue
+			}
+
+			count++
+			wg.Add(1)
+			out <- d
+		}
+
+		if resp.NextPage == 0 {
+			return count, nil
+		}
+		opt.Page = resp.NextPage
+		pause()
+	}
+}
+
+// mkdirs creates the owner and gist directories of a gist's owner.
+func mkdirs(base, dir string) error {
+	if err := mkdir(base, filepath.Dir(dir)); err != nil {
+		return err
+	}
+	return mkdir(base, dir)
+}
+
+// gistFilter returns the filter of the gists of a target filtered by f. Only
+// -x applies to gists, by their OWNER/@gists/ID names.
+func gistFilter(f *filter) *filter {
+	return &filter{exclude: f.exclude, warnOnly: f.warnOnly}
+}
+
+// gistSSH returns the ssh URL of a gist, on the host of its pull URL, such as
+// git@gist.github.com:ID.git.
+func gistSSH(g *github.Gist) string {
+	u, err := url.Parse(g.GetGitPullURL())
+	if err != nil || u.Host == "" {
+		return fmt.Sprintf("git@gist.%s:%s.git", gitHost, g.GetID())
+	}
+	return "git@" + u.Hostname() + ":" + strings.TrimPrefix(u.Path, "/")
+}
+
+// newGistDl returns the download of a gist, filtered by f. Its owner is the
+// gist directory of the gist's owner, which clone clones it into.
+func newGistDl(g *github.Gist, f *filter) dl {
+	login := g.GetOwner().GetLogin()
+
+	var size uint64
+	for _, f := range g.Files {
+		size += uint64(f.GetSize())
+	}
+
+	return dl{
+		git:      g.GetGitPullURL(),
+		ssh:      gistSSH(g),
+		https:    g.GetGitPullURL(),
+		fullname: login + "/" + gistDir + "/" + g.GetID(),
+		owner:    filepath.Join(login, gistDir),
+		name:     g.GetID(),
+		private:  !g.GetPublic(),
+		size:     size,
+		filter:   f,
+		gist:     true,
+
+		description: g.GetDescription(),
+		created:     g.GetCreatedAt(),
+	}
+}
@@ -0,0 +1,74 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestGistSSH(t *testing.T) {
+	for pull, want := range map[string]string{
+		"https://gist.github.com/abc.git":  "git@gist.github.com:abc.git",
+		"https://ghe.example/gist/abc.git": "git@ghe.example:gist/abc.git",
+	} {
+		g := &github.Gist{ID: github.String("abc"), GitPullURL: github.String(pull)}
+		if got := gistSSH(g); got != want {
+			t.Errorf("ssh URL of %s is %s, want %s", pull, got, want)
+		}
+	}
+}
+
+func TestDiscoverUserGistsFiltered(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+
+	f, client := newFakeGitHub(t)
+	gist := func(id string) map[string]interface{} {
+		return map[string]interface{}{
+			"id":           id,
+			"public":       true,
+			"git_pull_url": f.URL + "/" + id + ".git",
+			"owner":        map[string]string{"login": "x"},
+		}
+	}
+	f.handleJSON("/users/x/gists", []map[string]interface{}{gist("a"), gist("b")})
+
+	dls := make(chan dl, 10)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	filt := &filter{exclude: []string{"x/@gists/b"}, langs: map[string]bool{"go": true}}
+	discoverUserGists(client, t.TempDir(), "x", filt, dls, &wg)
+	close(dls)
+
+	var kept []string
+	for d := range dls {
+		if !d.filter.excluded(d.fullname) {
+			kept = append(kept, d.fullname)
+		}
+		if d.filter.langs != nil {
+			t.Errorf("%s: repo filters apply to gists", d.fullname)
+		}
+	}
+	if len(kept) != 1 || kept[0] != "x/@gists/a" {
+		t.Errorf("kept %v, want [x/@gists/a]", kept)
+	}
+}
@@ -0,0 +1,262 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// fakeGitHub is an httptest server answering API requests with canned JSON.
+type fakeGitHub struct {
+	*httptest.Server
+	mux *http.ServeMux
+
+	mu       sync.Mutex
+	searches map[string][][]map[string]interface{}
+}
+
+// newFakeGitHub starts a fake API server, stopped at the end of the test, and
+// returns it with a client pointed at it.
+func newFakeGitHub(t *testing.T) (*fakeGitHub, *github.Client) {
+	t.Helper()
+
+	f := &fakeGitHub{
+		mux:      http.NewServeMux(),
+		searches: make(map[string][][]map[string]interface{}),
+	}
+	f.Server = httptest.NewServer(f.mux)
+	t.Cleanup(f.Close)
+
+	f.mux.HandleFunc("/search/repositories", func(w http.ResponseWriter, r *http.Request) {
+		var owner string
+		fmt.Sscanf(r.URL.Query().Get("q"), "user:%q", &owner)
+
+		f.mu.Lock()
+		pages := f.searches[owner]
+		f.mu.Unlock()
+		f.servePage(w, r, pages, searchResult)
+	})
+
+	client := github.NewClient(nil)
+	u, err := url.Parse(f.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BaseURL = u
+	return f, client
+}
+
+// handleJSON serves v as JSON at path.
+func (f *fakeGitHub) handleJSON(path string, v interface{}) {
+	f.mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, http.StatusOK, v)
+	})
+}
+
+// handleOwner serves the account of login, of kind "User" or "Organization",
+// and its repos, in pages, from every endpoint listing them: the user's and
+// organization's repo lists and the repo search.
+func (f *fakeGitHub) handleOwner(login, kind string, pages ...[]map[string]interface{}) {
+	f.handleJSON("/users/"+login, map[string]string{
+		"login": login,
+		"type":  kind,
+	})
+
+	list := func(w http.ResponseWriter, r *http.Request) {
+		f.servePage(w, r, pages, repoList)
+	}
+	f.mux.HandleFunc("/users/"+login+"/repos", list)
+	f.mux.HandleFunc("/orgs/"+login+"/repos", list)
+
+	f.mu.Lock()
+	f.searches[login] = pages
+	f.mu.Unlock()
+}
+
+// servePage serves the page of pages the request asks for, with the Link
+// header GitHub paginates with. wrap turns a page into the response body.
+func (f *fakeGitHub) servePage(w http.ResponseWriter, r *http.Request, pages [][]map[string]interface{}, wrap func([]map[string]interface{}) interface{}) {
+	page := 1
+	if p := r.URL.Query().Get("page"); p != "" {
+		fmt.Sscan(p, &page)
+	}
+	if page < 1 || page > len(pages) {
+		writeTestJSON(w, http.StatusOK, wrap(nil))
+		return
+	}
+
+	link := func(n int, rel string) string {
+		q := r.URL.Query()
+		q.Set("page", fmt.Sprint(n))
+		return fmt.Sprintf(`<%s%s?%s>; rel="%s"`, f.URL, r.URL.Path, q.Encode(),
+			rel)
+	}
+	if page < len(pages) {
+		w.Header().Set("Link", link(page+1, "next")+", "+
+			link(len(pages), "last"))
+	}
+	writeTestJSON(w, http.StatusOK, wrap(pages[page-1]))
+}
+
+// searchResult wraps repos in a repository search response.
+func searchResult(repos []map[string]interface{}) interface{} {
+	return map[string]interface{}{
+		"total_count":        len(repos),
+		"incomplete_results": false,
+		"items":              repoList(repos),
+	}
+}
+
+// repoList wraps repos in a plain list response.
+func repoList(repos []map[string]interface{}) interface{} {
+	if repos == nil {
+		return []map[string]interface{}{}
+	}
+	return repos
+}
+
+func writeTestJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// testRepo returns the API JSON of owner/name, cloned from url.
+func testRepo(owner, name, url string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":      name,
+		"full_name": owner + "/" + name,
+		"owner":     map[string]string{"login": owner},
+		"git_url":   url,
+		"ssh_url":   url,
+		"clone_url": url,
+		"private":   false,
+		"size":      1,
+	}
+}
+
+// bareRepo creates a bare git repo named name in dir with one commit adding
+// the given files, and returns its file:// URL.
+func bareRepo(t *testing.T, dir, name string, files map[string]string) string {
+	t.Helper()
+
+	work := filepath.Join(dir, name+"-work")
+	bare := filepath.Join(dir, name+".git")
+
+	testGit(t, "", "init", "-q", work)
+	for file, content := range files {
+		path := filepath.Join(work, filepath.FromSlash(file))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testGit(t, work, "add", "-A")
+	testGit(t, work, "-c", "user.name=test", "-c", "user.email=test@example.com",
+		"commit", "-q", "-m", "initial")
+	testGit(t, "", "clone", "-q", "--bare", work, bare)
+
+	return "file://" + filepath.ToSlash(bare)
+}
+
+func testGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v: %s", args, err, out)
+	}
+}
+
+// testMsgs replaces msgs with a channel collected until the returned function
+// is called, which returns everything sent.
+func testMsgs(t *testing.T) func() []interface{} {
+	t.Helper()
+
+	msgs = make(chan interface{})
+	var got []interface{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range msgs {
+			got = append(got, m)
+		}
+	}()
+
+	var once sync.Once
+	stop := func() []interface{} {
+		once.Do(func() {
+			close(msgs)
+			<-done
+		})
+		return got
+	}
+	t.Cleanup(func() { stop() })
+	return stop
+}
+
+// resetGlobals restores the state a run starts with, as the flags default, so
+// tests do not see each other's repos and counters.
+func resetGlobals(t *testing.T) {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	total, successful, estimated, empty, unchanged = 0, 0, 0, 0, 0
+	queued = make(map[string]bool)
+	accounted = make(map[string]bool)
+	downloaded = make(map[string]string)
+	cursors = make(map[string]int)
+	limitReset = time.Time{}
+	interval = 0
+	ownerKind = "auto"
+	level = gzip.DefaultCompression
+	maxWait = defaultMaxWait
+	defaults = filter{}
+	mirror = false
+	pushTo = ""
+	blocking = 0
+	stateFile = ""
+	recheck = false
+	treeOn = false
+	follow, parents = false, false
+	pruneEmpty = false
+	manifest = ""
+	heads = make(map[string]manifestEntry)
+	fresh = make(map[string]bool)
+	prs, issues, releases, settingsOn = false, false, false, false
+}
@@ -0,0 +1,74 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// job is a group of names downloaded with their own filter, from -jobs-file.
+type job struct {
+	Names []string `json:"names"`
+	Flags []string `json:"flags"`
+}
+
+// target is a name to download and the filter applied to its repos.
+type target struct {
+	name   string
+	filter *filter
+}
+
+// readJobs reads the targets of a jobs file. The flags of each job override
+// the filter of the command line.
+func readJobs(name string) ([]target, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var jobs []job
+	if err := json.NewDecoder(f).Decode(&jobs); err != nil {
+		return nil, err
+	}
+
+	var targets []target
+	for i, j := range jobs {
+		jf := defaults
+		fs := flag.NewFlagSet(fmt.Sprintf("job %d", i+1), flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		jf.register(fs)
+		if err := fs.Parse(j.Flags); err != nil {
+			return nil, fmt.Errorf("job %d: %v", i+1, err)
+		}
+		if fs.NArg() != 0 {
+			return nil, fmt.Errorf("job %d: unexpected argument %s", i+1,
+				fs.Arg(0))
+		}
+
+		for _, n := range j.Names {
+			targets = append(targets, target{name: n, filter: &jf})
+		}
+	}
+	return targets, nil
+}
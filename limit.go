@@ -0,0 +1,121 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Address of the local proxy limiting the bandwidth of clones, with -rate-limit
+var limiter string
+
+// startLimiter starts a local HTTP proxy that limits each connection through
+// it to bandwidth bytes per second in each direction.
+func startLimiter() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	limiter = ln.Addr().String()
+
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				msgs <- err
+				return
+			}
+			go proxyConn(c)
+		}
+	}()
+
+	return nil
+}
+
+// proxyConn serves one proxy connection: a CONNECT tunnel, as used for https
+// and ssh, or a plain http request, after which the connection is tunneled to
+// the same host.
+func proxyConn(c net.Conn) {
+	defer c.Close()
+
+	r := bufio.NewReader(c)
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return
+	}
+
+	host := req.URL.Host
+	if req.Method == http.MethodConnect {
+		host = req.Host
+	} else if req.URL.Port() == "" {
+		host += ":80"
+	}
+
+	up, err := net.Dial("tcp", host)
+	if err != nil {
+		_, _ = io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return
+	}
+	defer up.Close()
+
+	if req.Method == http.MethodConnect {
+		_, err = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+	} else {
+		err = req.Write(up)
+	}
+	if err != nil {
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(&limitWriter{w: up, start: time.Now()}, r)
+		if tcp, ok := up.(*net.TCPConn); ok {
+			_ = tcp.CloseWrite()
+		}
+	}()
+
+	_, _ = io.Copy(&limitWriter{w: c, start: time.Now()}, up)
+	_ = c.Close()
+	wg.Wait()
+}
+
+// limitWriter writes no faster than bandwidth bytes per second on average.
+type limitWriter struct {
+	w     io.Writer
+	start time.Time
+	n     int64
+}
+
+func (l *limitWriter) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+	l.n += int64(n)
+
+	due := l.start.Add(time.Duration(float64(l.n) / float64(bandwidth) *
+		float64(time.Second)))
+	time.Sleep(time.Until(due))
+	return n, err
+}
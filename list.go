@@ -0,0 +1,222 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/github"
+)
+
+// Star lists are named as list:user/slug.
+const listPrefix = "list:"
+
+const (
+	listsQuery = `query($login: String!) {
+	user(login: $login) {
+		lists(first: 100) {
+			nodes { id slug }
+		}
+	}
+}`
+	listItemsQuery = `query($id: ID!, $after: String) {
+	node(id: $id) {
+		... on UserList {
+			items(first: 100, after: $after) {
+				pageInfo { hasNextPage endCursor }
+				nodes { ... on Repository { nameWithOwner } }
+			}
+		}
+	}
+}`
+)
+
+// isList reports whether arg names a star list.
+func isList(arg string) bool {
+	return strings.HasPrefix(arg, listPrefix)
+}
+
+// discoverList queues every repo of the star list in.repo of user in.owner, as
+// if each were named individually.
+func discoverList(client *github.Client, base string, in query, out chan<- dl, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ctx := context.Background()
+	name := listPrefix + in.owner + "/" + in.repo
+
+	id, err := listID(ctx, client, in.owner, in.repo)
+	if err != nil {
+		msgs <- fmt.Errorf("%s: %v", name, err)
+		return
+	}
+
+	repos, err := listRepos(ctx, client, id)
+	if err != nil {
+		msgs <- fmt.Errorf("%s: %v", name, err)
+		return
+	}
+
+	msgs <- msg{
+		s: fmt.Sprintf("found %d repos in %s", len(repos), name),
+		v: false,
+	}
+
+	for _, r := range repos {
+		split := strings.SplitN(r, "/", 2)
+		if len(split) != 2 {
+			continue
+		}
+
+		wg.Add(1)
+		queryOwner(client, base, query{
+			kind:   queryRepo,
+			owner:  split[0],
+			repo:   split[1],
+			filter: in.filter,
+		}, out, wg)
+	}
+}
+
+// listID returns the GraphQL node ID of a user's star list.
+func listID(ctx context.Context, client *github.Client, user, slug string) (string, error) {
+	var data struct {
+		User *struct {
+			Lists struct {
+				Nodes []struct {
+					ID   string
+					Slug string
+				}
+			}
+		}
+	}
+
+	if err := graphQL(ctx, client, listsQuery, map[string]interface{}{
+		"login": user,
+	}, &data); err != nil {
+		return "", err
+	}
+
+	if data.User == nil {
+		return "", fmt.Errorf("user %s does not exist", user)
+	}
+
+	for _, l := range data.User.Lists.Nodes {
+		if strings.EqualFold(l.Slug, slug) {
+			return l.ID, nil
+		}
+	}
+
+	return "", errors.New("list does not exist")
+}
+
+// listRepos returns the full names of the repos in a star list.
+func listRepos(ctx context.Context, client *github.Client, id string) ([]string, error) {
+	var repos []string
+	var after *string
+
+	for {
+		var data struct {
+			Node struct {
+				Items struct {
+					PageInfo struct {
+						HasNextPage bool
+						EndCursor   string
+					}
+					Nodes []struct {
+						NameWithOwner string
+					}
+				}
+			}
+		}
+
+		if err := graphQL(ctx, client, listItemsQuery, map[string]interface{}{
+			"id":    id,
+			"after": after,
+		}, &data); err != nil {
+			return nil, err
+		}
+
+		items := data.Node.Items
+		for _, n := range items.Nodes {
+			// Items other than repos have no name
+			if n.NameWithOwner != "" {
+				repos = append(repos, n.NameWithOwner)
+			}
+		}
+
+		if !items.PageInfo.HasNextPage {
+			return repos, nil
+		}
+		after = &items.PageInfo.EndCursor
+		pause()
+	}
+}
+
+// graphQL runs a GraphQL query against the API, decoding its data into v.
+func graphQL(ctx context.Context, client *github.Client, q string, vars map[string]interface{}, v interface{}) error {
+	// GitHub Enterprise serves GraphQL beside the v3 API, not within it
+	u := *client.BaseURL
+	u.Path = strings.TrimSuffix(u.Path, "v3/") + "graphql"
+
+	req, err := client.NewRequest("POST", u.String(), map[string]interface{}{
+		"query":     q,
+		"variables": vars,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		var out struct {
+			Data   interface{}
+			Errors []struct {
+				Type    string
+				Message string
+			}
+		}
+		out.Data = v
+
+		resp, err := do(ctx, client, req, &out)
+		if err != nil {
+			return err
+		}
+
+		if len(out.Errors) == 0 {
+			return nil
+		}
+
+		// GraphQL can report the rate limit running out as a query error
+		e := out.Errors[0]
+		if e.Type != "RATE_LIMITED" || !waitRateLimit(&github.RateLimitError{
+			Rate:     resp.Rate,
+			Response: resp.Response,
+			Message:  e.Message,
+		}) {
+			return errors.New(e.Message)
+		}
+
+		if err := rewind(req); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGraphQLWaitsForRateLimit(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+
+	f, client := newFakeGitHub(t)
+
+	var tries int32
+	f.mux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		// Limited once with an HTTP error, then once with a query error
+		n := atomic.AddInt32(&tries, 1)
+		if n <= 2 {
+			reset := time.Now().Add(time.Second).Unix()
+			w.Header().Set("X-RateLimit-Limit", "5000")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+		}
+		switch n {
+		case 1:
+			writeTestJSON(w, http.StatusForbidden, map[string]string{
+				"message": "API rate limit exceeded for user ID 1.",
+			})
+			return
+		case 2:
+			writeTestJSON(w, http.StatusOK, map[string]interface{}{
+				"errors": []map[string]string{{
+					"type":    "RATE_LIMITED",
+					"message": "API rate limit exceeded for user ID 1.",
+				}},
+			})
+			return
+		}
+
+		// The query is sent again with the retry
+		var body struct {
+			Query string
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Query != "{ x }" {
+			writeTestJSON(w, http.StatusBadRequest, map[string]string{
+				"message": "bad query",
+			})
+			return
+		}
+		writeTestJSON(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]string{"x": "y"},
+		})
+	})
+
+	var got struct {
+		X string
+	}
+	if err := graphQL(context.Background(), client, "{ x }", nil, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.X != "y" {
+		t.Errorf("decoded %q, want y", got.X)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type manifestEntry struct {
+	Name     string `json:"name"`
+	Head     string `json:"head"`
+	URL      string `json:"url,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
+var (
+	// HEAD commits of the previous run, from -delta
+	prev map[string]string
+
+	// HEAD commits of this run, and the URLs they were fetched from
+	heads   = make(map[string]manifestEntry)
+	headsMu sync.Mutex
+)
+
+// record notes the HEAD commit of a repo for the manifest, and the URL it was
+// cloned from.
+func record(path, head, url string) {
+	headsMu.Lock()
+	heads[path] = manifestEntry{
+		Name:     path,
+		Head:     head,
+		URL:      url,
+		Protocol: urlProtocol(url),
+	}
+	headsMu.Unlock()
+}
+
+// urlProtocol returns the protocol of a clone URL: https, http, ssh, git, or
+// file for local repos.
+func urlProtocol(url string) string {
+	if i := strings.Index(url, "://"); i >= 0 {
+		return url[:i]
+	}
+	if strings.HasPrefix(url, "/") {
+		return "file"
+	}
+	// scp-like ssh, such as git@github.com:esote/gh-dl.git
+	return "ssh"
+}
+
+func readManifest(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []manifestEntry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string, len(entries))
+	for _, e := range entries {
+		m[e.Name] = e.Head
+	}
+	return m, nil
+}
+
+func writeManifest(name string) error {
+	headsMu.Lock()
+	names := make([]string, 0, len(heads))
+	for n := range heads {
+		names = append(names, n)
+	}
+
+	if byCreated {
+		sortByCreated(names)
+	} else {
+		sort.Strings(names)
+	}
+
+	entries := make([]manifestEntry, len(names))
+	for i, n := range names {
+		entries[i] = heads[n]
+	}
+	headsMu.Unlock()
+
+	return writeJSON(name, entries)
+}
@@ -0,0 +1,360 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// Directory under an organization's owner directory holding its metadata. The
+// "@" keeps it apart from repos, whose names cannot contain one.
+const orgMetaDir = "@org-meta"
+
+// writeOrgMeta saves the teams, team members, and members of an organization.
+// Parts the token is not permitted to see are reported and skipped.
+func writeOrgMeta(ctx context.Context, client *github.Client, base, org string) error {
+	dir := filepath.Join(base, org, orgMetaDir)
+	if err := os.MkdirAll(filepath.Join(dir, "teams"), 0700); err != nil {
+		return err
+	}
+
+	members, err := listUsers(ctx, client, "orgs/"+org+"/members")
+	if err != nil {
+		if !denied(err) {
+			return err
+		}
+		msgs <- fmt.Errorf("%s: cannot list members: %v", org, err)
+	}
+
+	if err := writeJSON(filepath.Join(dir, "members.json"), members); err != nil {
+		return err
+	}
+
+	var teams []*github.Team
+	for page := 1; page != 0; {
+		u := fmt.Sprintf("orgs/%s/teams?per_page=100&page=%d", org, page)
+		req, err := client.NewRequest("GET", u, nil)
+		if err != nil {
+			return err
+		}
+
+		var list []*github.Team
+		resp, err := do(ctx, client, req, &list)
+		if err != nil {
+			if !denied(err) {
+				return err
+			}
+			msgs <- fmt.Errorf("%s: cannot list teams: %v", org, err)
+			break
+		}
+		teams = append(teams, list...)
+		page = resp.NextPage
+	}
+
+	if err := writeJSON(filepath.Join(dir, "teams.json"), teams); err != nil {
+		return err
+	}
+
+	for _, team := range teams {
+		members, err := listUsers(ctx, client,
+			"orgs/"+org+"/teams/"+team.GetSlug()+"/members")
+		if err != nil {
+			if !denied(err) {
+				return err
+			}
+			msgs <- fmt.Errorf("%s: cannot list members of team %s: %v",
+				org, team.GetSlug(), err)
+			continue
+		}
+
+		name := filepath.Join(dir, "teams", team.GetSlug()+".json")
+		if err := writeJSON(name, members); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listUsers reads every page of users listed at u, waiting for the rate limit.
+// On an error it returns the users of the pages read so far.
+func listUsers(ctx context.Context, client *github.Client, u string) ([]*github.User, error) {
+	var users []*github.User
+	for page := 1; page != 0; {
+		req, err := client.NewRequest("GET",
+			fmt.Sprintf("%s?per_page=100&page=%d", u, page), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var list []*github.User
+		resp, err := do(ctx, client, req, &list)
+		if err != nil {
+			return users, err
+		}
+		users = append(users, list...)
+		page = resp.NextPage
+	}
+	return users, nil
+}
+
+// writePulls saves every pull request of a repo to pulls.json in its clone,
+// unless the repo has its own file of that name.
+func writePulls(ctx context.Context, client *github.Client, dir string, in dl) error {
+	if err := clearSubdir(ctx, dir, "pulls.json"); err != nil {
+		return err
+	}
+
+	var pulls []*github.PullRequest
+	opt := &github.PullRequestListOptions{
+		State:       "all",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		page, resp, err := client.PullRequests.List(ctx, in.login, in.name, opt)
+		if err != nil {
+			return err
+		}
+		pulls = append(pulls, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	return writeJSON(filepath.Join(dir, "pulls.json"), pulls)
+}
+
+// writeIssues saves every issue of a repo to issues.json in its clone, unless
+// the repo has its own file of that name. The issues API also lists pull
+// requests, with their pull_request field set.
+func writeIssues(ctx context.Context, client *github.Client, dir string, in dl) error {
+	if err := clearSubdir(ctx, dir, "issues.json"); err != nil {
+		return err
+	}
+
+	var issues []*github.Issue
+	opt := &github.IssueListByRepoOptions{
+		State:       "all",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		page, resp, err := client.Issues.ListByRepo(ctx, in.login, in.name, opt)
+		if err != nil {
+			return err
+		}
+		issues = append(issues, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	return writeJSON(filepath.Join(dir, "issues.json"), issues)
+}
+
+// settings is the configuration of a repo that lives outside git.
+type settings struct {
+	DefaultBranch    string                        `json:"default_branch"`
+	Homepage         string                        `json:"homepage,omitempty"`
+	Topics           []string                      `json:"topics,omitempty"`
+	Archived         bool                          `json:"archived"`
+	HasIssues        bool                          `json:"has_issues"`
+	HasWiki          bool                          `json:"has_wiki"`
+	HasPages         bool                          `json:"has_pages"`
+	HasProjects      bool                          `json:"has_projects"`
+	AllowMergeCommit bool                          `json:"allow_merge_commit"`
+	AllowSquashMerge bool                          `json:"allow_squash_merge"`
+	AllowRebaseMerge bool                          `json:"allow_rebase_merge"`
+	Protection       map[string]*github.Protection `json:"branch_protection,omitempty"`
+}
+
+// writeSettings saves the settings and branch protection rules of a repo to
+// settings.json in its clone, unless the repo has its own file of that name.
+// Protection rules require admin access to the repo; without it, they are
+// reported and omitted.
+func writeSettings(ctx context.Context, client *github.Client, dir string, in dl) error {
+	if err := clearSubdir(ctx, dir, "settings.json"); err != nil {
+		return err
+	}
+
+	repo, _, err := client.Repositories.Get(ctx, in.login, in.name)
+	if err != nil {
+		return err
+	}
+
+	s := settings{
+		DefaultBranch:    repo.GetDefaultBranch(),
+		Homepage:         repo.GetHomepage(),
+		Topics:           repo.Topics,
+		Archived:         repo.GetArchived(),
+		HasIssues:        repo.GetHasIssues(),
+		HasWiki:          repo.GetHasWiki(),
+		HasPages:         repo.GetHasPages(),
+		HasProjects:      repo.GetHasProjects(),
+		AllowMergeCommit: repo.GetAllowMergeCommit(),
+		AllowSquashMerge: repo.GetAllowSquashMerge(),
+		AllowRebaseMerge: repo.GetAllowRebaseMerge(),
+		Protection:       make(map[string]*github.Protection),
+	}
+
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		branches, resp, err := client.Repositories.ListBranches(ctx, in.login,
+			in.name, opt)
+		if err != nil {
+			return err
+		}
+
+		for _, b := range branches {
+			if !b.GetProtected() {
+				continue
+			}
+
+			p, _, err := client.Repositories.GetBranchProtection(ctx, in.login,
+				in.name, b.GetName())
+			if err != nil {
+				if !denied(err) {
+					return err
+				}
+				msgs <- fmt.Errorf("%s: cannot read protection of branch %s: %v",
+					in.fullname, b.GetName(), err)
+				continue
+			}
+			s.Protection[b.GetName()] = p
+		}
+
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	return writeJSON(filepath.Join(dir, "settings.json"), s)
+}
+
+// metadata is the summary of a repo saved by -catalog and -metadata.
+type metadata struct {
+	Name          string     `json:"name"`
+	Description   string     `json:"description"`
+	Language      string     `json:"language"`
+	DefaultBranch string     `json:"default_branch"`
+	Stars         int        `json:"stars"`
+	Private       bool       `json:"private"`
+	Fork          bool       `json:"fork"`
+	Size          uint64     `json:"size"`
+	URL           string     `json:"url"`
+	Cloned        *time.Time `json:"cloned,omitempty"`
+}
+
+// newMetadata returns the summary of a repo, as discovered.
+func newMetadata(in dl) metadata {
+	return metadata{
+		Name:          in.fullname,
+		Description:   in.description,
+		Language:      in.language,
+		DefaultBranch: in.branch,
+		Stars:         in.stars,
+		Private:       in.private,
+		Fork:          in.fork,
+		Size:          in.size,
+		URL:           in.https,
+	}
+}
+
+// writeMetadata saves the summary of a repo, along with when it was cloned, to
+// metadata.json in its clone, unless the repo has its own file of that name.
+func writeMetadata(ctx context.Context, dir string, in dl, cloned time.Time) error {
+	if err := clearSubdir(ctx, dir, "metadata.json"); err != nil {
+		return err
+	}
+
+	meta := newMetadata(in)
+	cloned = cloned.UTC().Truncate(time.Second)
+	meta.Cloned = &cloned
+	return writeJSON(filepath.Join(dir, "metadata.json"), meta)
+}
+
+// writeCatalog saves the README and metadata of a repo instead of cloning it.
+func writeCatalog(client *github.Client, base string, in dl) error {
+	dir := filepath.Join(base, in.owner, in.name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	if err := writeJSON(filepath.Join(dir, "meta.json"), newMetadata(in)); err != nil {
+		return err
+	}
+
+	if in.local {
+		return nil
+	}
+
+	readme, _, err := client.Repositories.GetReadme(context.Background(),
+		in.login, in.name, nil)
+	if err != nil {
+		if denied(err) {
+			return nil
+		}
+		return err
+	}
+
+	content, err := readme.GetContent()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, "README"), []byte(content), 0600)
+}
+
+// denied reports whether err is the API refusing access to a resource.
+func denied(err error) bool {
+	e, ok := err.(*github.ErrorResponse)
+	if !ok || e.Response == nil {
+		return false
+	}
+	return e.Response.StatusCode == http.StatusForbidden ||
+		e.Response.StatusCode == http.StatusNotFound
+}
+
+func writeJSON(name string, v interface{}) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	e := json.NewEncoder(f)
+	e.SetIndent("", "\t")
+
+	if err := e.Encode(v); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	return f.Close()
+}
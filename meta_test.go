@@ -0,0 +1,92 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// TestWriteOrgMetaWaitsForRateLimit checks that the organization's members and
+// teams are listed through the rate limit instead of failing on it.
+func TestWriteOrgMetaWaitsForRateLimit(t *testing.T) {
+	resetGlobals(t)
+	stop := testMsgs(t)
+
+	f, client := newFakeGitHub(t)
+	f.handleJSON("/orgs/x/members", []map[string]string{{"login": "m"}})
+	f.handleJSON("/orgs/x/teams", []map[string]string{{"slug": "t"}})
+
+	var limited int32
+	f.mux.HandleFunc("/orgs/x/teams/t/members", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt32(&limited, 0, 1) {
+			reset := time.Now().Add(time.Second).Unix()
+			w.Header().Set("X-RateLimit-Limit", "60")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+			writeTestJSON(w, http.StatusForbidden, map[string]string{
+				"message": "API rate limit exceeded for 127.0.0.1.",
+			})
+			return
+		}
+		writeTestJSON(w, http.StatusOK, []map[string]string{{"login": "m"}})
+	})
+
+	base := t.TempDir()
+	if err := writeOrgMeta(context.Background(), client, base, "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(base, "x", orgMetaDir, "teams", "t.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var members []*github.User
+	if err := json.Unmarshal(b, &members); err != nil {
+		t.Fatal(err)
+	}
+	var logins []string
+	for _, m := range members {
+		logins = append(logins, m.GetLogin())
+	}
+	if want := []string{"m"}; !reflect.DeepEqual(logins, want) {
+		t.Errorf("team members %v, want %v", logins, want)
+	}
+
+	waited := false
+	for _, m := range stop() {
+		if m, ok := m.(msg); ok && strings.HasPrefix(m.s, "API rate limited") {
+			waited = true
+		}
+	}
+	if !waited {
+		t.Error("rate limit not waited for")
+	}
+}
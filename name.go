@@ -0,0 +1,177 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultName returns the name of an archive of a run started at now, without
+// -o.
+func defaultName(now time.Time) string {
+	return fmt.Sprintf("gh-dl-%d.tar.gz", now.Unix())
+}
+
+// outPath returns the path of the archive an -o template names: the expanded
+// template, or the default name inside it if it is a directory.
+func outPath(tmpl string, now time.Time, targets []target, count uint64) string {
+	name := expandName(tmpl, now, targets, count)
+	if strings.HasSuffix(name, string(filepath.Separator)) {
+		return filepath.Join(name, defaultName(now))
+	}
+	if i, err := os.Stat(name); err == nil && i.IsDir() {
+		return filepath.Join(name, defaultName(now))
+	}
+	return name
+}
+
+// checkNew fails if an archive named name, or its first volume, already
+// exists, unless -f is given.
+func checkNew(name string) error {
+	if force {
+		return nil
+	}
+
+	for _, f := range []string{name, name + ".001"} {
+		if _, err := os.Lstat(f); err == nil {
+			return fmt.Errorf("%s already exists, use -f to overwrite it", f)
+		}
+	}
+	return nil
+}
+
+// checkDir fails if the directory an archive is written to does not exist.
+func checkDir(name string) error {
+	dir := filepath.Dir(name)
+	i, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !i.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return nil
+}
+
+// checkNames runs checkDir and checkNew before downloading on every archive
+// whose name is already known, which is all but those of templates with
+// {count}. The directory is also known if only the file name has {count}.
+func checkNames(now time.Time, targets []target) error {
+	if len(outNames) == 0 {
+		return checkNew(defaultName(now))
+	}
+
+	for _, tmpl := range outNames {
+		name := outPath(tmpl, now, targets, 0)
+		if !strings.Contains(filepath.Dir(tmpl), "{count}") {
+			if err := checkDir(name); err != nil {
+				return err
+			}
+		}
+
+		if strings.Contains(tmpl, "{count}") {
+			continue
+		}
+		if err := checkNew(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expandName expands the placeholders of an -o template for a run started at
+// now, downloading count repos of targets.
+func expandName(tmpl string, now time.Time, targets []target, count uint64) string {
+	var owners []string
+	seen := make(map[string]bool)
+	for _, t := range targets {
+		owner := strings.SplitN(strings.TrimPrefix(t.name, listPrefix), "/",
+			2)[0]
+		if isStars(t.name) {
+			owner = strings.TrimPrefix(t.name, starsPrefix)
+		}
+		if isLocal(t.name) {
+			owner = localOwner
+		}
+		if !seen[owner] {
+			seen[owner] = true
+			owners = append(owners, owner)
+		}
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return strings.NewReplacer(
+		"{date}", now.Format("2006-01-02"),
+		"{time}", now.Format("150405"),
+		"{owner}", strings.Join(owners, "+"),
+		"{count}", strconv.FormatUint(count, 10),
+		"{host}", host,
+	).Replace(tmpl)
+}
+
+// finalNames returns the names of the archive once all repos are downloaded:
+// the expanded -o templates, or names without them.
+func finalNames(names []string, now time.Time, targets []target) []string {
+	if len(outNames) == 0 {
+		return names
+	}
+
+	finals := make([]string, len(outNames))
+	for i, tmpl := range outNames {
+		finals[i] = outPath(tmpl, now, targets, successful)
+	}
+	return finals
+}
+
+// renameArchive renames the files of an archive, or its volumes, from name to
+// final.
+func renameArchive(files []string, name, final string) ([]string, error) {
+	renamed := make([]string, len(files))
+	for i, f := range files {
+		renamed[i] = final + strings.TrimPrefix(f, name)
+		if err := os.Rename(f, renamed[i]); err != nil {
+			return nil, err
+		}
+	}
+	return renamed, nil
+}
+
+// partNames returns the temporary names of the archive written with -pipeline
+// before its -o names are known, one for each -o.
+func partNames(now time.Time, targets []target) []string {
+	parts := make([]string, len(outNames))
+	for i, tmpl := range outNames {
+		dir := filepath.Dir(outPath(tmpl, now, targets, 0))
+		part := ".gh-dl-" + strconv.FormatInt(now.Unix(), 10)
+		if i > 0 {
+			part += "-" + strconv.Itoa(i+1)
+		}
+		parts[i] = filepath.Join(dir, part+".tar.gz.part")
+	}
+	return parts
+}
@@ -0,0 +1,54 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// Creation time of each downloaded repo, for -by-created
+	created   = make(map[string]time.Time)
+	createdMu sync.Mutex
+)
+
+// setCreated notes when a repo was created on GitHub.
+func setCreated(path string, t time.Time) {
+	createdMu.Lock()
+	created[path] = t
+	createdMu.Unlock()
+}
+
+// sortByCreated sorts repo paths, as OWNER/NAME, from the oldest repo to the
+// newest. Paths without a creation time, such as local repos, sort first, and
+// ties are broken by path.
+func sortByCreated(names []string) {
+	createdMu.Lock()
+	defer createdMu.Unlock()
+
+	sort.SliceStable(names, func(i, j int) bool {
+		a, b := created[names[i]], created[names[j]]
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return names[i] < names[j]
+	})
+}
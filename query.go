@@ -21,12 +21,13 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
 
 	"github.com/google/go-github/github"
 )
@@ -34,22 +35,50 @@ import (
 const (
 	queryRepo = iota
 	queryUser
+	queryLocal
+	queryList
+	queryStars
+)
+
+// Local repos are archived under this owner directory.
+const localOwner = "local"
+
+var (
+	// Repos queued for download, by lowercase full name
+	queued   = make(map[string]bool)
+	queuedMu sync.Mutex
 )
 
 type query struct {
-	kind  int
-	owner string
-	repo  string
+	kind     int
+	owner    string
+	repo     string
+	filter   *filter
+	branches []string
+	orgs     bool
+
+	// Owner known to be an organization, regardless of -k
+	org bool
 }
 
 func consumeQueries(client *github.Client, base string, in <-chan query, out chan<- dl, wg *sync.WaitGroup) {
 	for query := range in {
-		go queryOwner(client, base, query, out, wg)
-		time.Sleep(sleep)
+		queryOwner(client, base, query, out, wg)
+		pause()
 	}
 }
 
 func queryOwner(client *github.Client, base string, in query, out chan<- dl, wg *sync.WaitGroup) {
+	// The repos of a list are archived under their own owners
+	if in.kind == queryList {
+		discoverList(client, base, in, out, wg)
+		return
+	}
+	if in.kind == queryStars {
+		discoverStarred(client, base, in, out, wg)
+		return
+	}
+
 	if err := mkdir(base, in.owner); err != nil {
 		msgs <- err
 		wg.Done()
@@ -58,59 +87,319 @@ func queryOwner(client *github.Client, base string, in query, out chan<- dl, wg
 
 	switch in.kind {
 	case queryRepo:
-		repo, _, err := client.Repositories.Get(context.Background(), in.owner, in.repo)
+		repo, _, err := getRepo(context.Background(), client, in.owner, in.repo)
 		if err != nil {
 			msgs <- err
+			wg.Done()
 			return
 		}
-		out <- dl{
-			git:      *repo.GitURL,
-			ssh:      *repo.SSHURL,
-			fullname: *repo.FullName,
-			owner:    in.owner,
-			private:  *repo.Private,
+
+		if !in.filter.visible(*repo.FullName, repo.visibility()) {
+			msgs <- msg{
+				s: fmt.Sprintf("skipped %s repo %s", repo.visibility(),
+					*repo.FullName),
+				v: true,
+			}
+			wg.Done()
+			return
 		}
 
+		if !in.filter.speaks(*repo.FullName, repo.GetLanguage()) {
+			wg.Done()
+			return
+		}
+
+		// The API follows renames; without -follow, the repo stays under the
+		// owner it was named with
+		owner := in.owner
+		if name := in.owner + "/" + in.repo; !strings.EqualFold(name, *repo.FullName) {
+			msgs <- msg{
+				s: fmt.Sprintf("repo %s renamed to %s", name, *repo.FullName),
+				v: false,
+			}
+
+			if follow {
+				owner = *repo.Owner.Login
+				if err := mkdir(base, owner); err != nil {
+					msgs <- err
+					wg.Done()
+					return
+				}
+			}
+		}
+
+		if !queue(*repo.FullName) {
+			msgs <- msg{
+				s: fmt.Sprintf("skipped duplicate repo %s", *repo.FullName),
+				v: true,
+			}
+			wg.Done()
+			return
+		}
+
+		d := newDl(&repo.Repository, owner, in.filter)
+		d.branches = in.branches
+		out <- d
+
 		msgs <- msg{
 			s: fmt.Sprintf("added individual repo %s", *repo.FullName),
 			v: true,
 		}
 		atomic.AddUint64(&total, 1)
+
+		if parents && repo.Parent != nil {
+			queueParent(base, repo.Parent, *repo.FullName, in.filter, out, wg)
+		}
 	case queryUser:
-		go discoverRepos(client, in, out, wg)
+		ctx := context.Background()
+		in.org = in.org || ownerIsOrg(ctx, client, in.owner)
+
+		if orgMeta && in.org {
+			if err := writeOrgMeta(ctx, client, base, in.owner); err != nil {
+				msgs <- fmt.Errorf("%s: org metadata: %v", in.owner, err)
+			}
+			setFresh(in.owner + "/" + orgMetaDir)
+		}
+
+		// Organizations cannot own gists
+		if gistsOn && !in.org {
+			wg.Add(1)
+			discoverUserGists(client, base, in.owner, in.filter, out, wg)
+		}
+
+		discover := discoverRepos
+		if in.org {
+			discover = discoverOrgRepos
+		}
+
+		if in.orgs {
+			wg.Add(1)
+			discover(client, base, in, out, wg)
+			queryOrgs(client, base, in, out, wg)
+			return
+		}
+
+		discover(client, base, in, out, wg)
+	case queryLocal:
+		path, err := filepath.Abs(localPath(in.repo))
+		if err != nil {
+			msgs <- err
+			wg.Done()
+			return
+		}
+
+		name := strings.TrimSuffix(filepath.Base(path), ".git")
+		if !queue(in.owner + "/" + name) {
+			msgs <- msg{
+				s: fmt.Sprintf("skipped duplicate repo %s/%s", in.owner, name),
+				v: true,
+			}
+			wg.Done()
+			return
+		}
+
+		out <- dl{
+			git:      path,
+			ssh:      path,
+			fullname: in.owner + "/" + name,
+			owner:    in.owner,
+			name:     name,
+			local:    true,
+			filter:   in.filter,
+		}
+		atomic.AddUint64(&total, 1)
+	}
+}
+
+// isLocal reports whether arg names a local git repo rather than a GitHub
+// owner or repo.
+func isLocal(arg string) bool {
+	return strings.HasPrefix(arg, "file://") || strings.HasPrefix(arg, "/") ||
+		strings.HasPrefix(arg, ".")
+}
+
+func localPath(arg string) string {
+	return strings.TrimPrefix(arg, "file://")
+}
+
+var (
+	ownerName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]*$`)
+	repoName  = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+// validName checks that a name is a local repo, a star list, the starred repos
+// of a user, an owner with an optional trailing slash, or owner/repo with
+// optional branches.
+func validName(name string) error {
+	if isLocal(name) {
+		return nil
+	}
+
+	if isList(name) {
+		split := strings.Split(strings.TrimPrefix(name, listPrefix), "/")
+		if len(split) != 2 || !ownerName.MatchString(split[0]) ||
+			!repoName.MatchString(split[1]) {
+			return fmt.Errorf("list %s invalid", name)
+		}
+		return nil
+	}
+
+	if isStars(name) {
+		if !ownerName.MatchString(strings.TrimPrefix(name, starsPrefix)) {
+			return fmt.Errorf("name %s invalid", name)
+		}
+		return nil
+	}
+
+	split := strings.Split(name, "/")
+	if len(split) > 2 || !ownerName.MatchString(split[0]) {
+		return fmt.Errorf("name %s invalid", name)
+	}
+
+	if len(split) == 2 && split[1] != "" {
+		repo := split[1]
+		if at := strings.SplitN(repo, "@", 2); len(at) == 2 {
+			repo = at[0]
+			for _, b := range strings.Split(at[1], ",") {
+				if b == "" {
+					return fmt.Errorf("name %s has an empty branch", name)
+				}
+			}
+		}
+
+		if !repoName.MatchString(repo) || repo == "." || repo == ".." {
+			return fmt.Errorf("name %s invalid", name)
+		}
 	}
+
+	return nil
 }
 
-func discoverRepos(client *github.Client, in query, out chan<- dl, wg *sync.WaitGroup) {
+// checkExists reports whether the owner or repo a name refers to exists,
+// with -check.
+func checkExists(client *github.Client, name string) error {
+	if isLocal(name) {
+		_, err := os.Stat(localPath(name))
+		return err
+	}
+
+	ctx := context.Background()
+
+	if isList(name) {
+		split := strings.Split(strings.TrimPrefix(name, listPrefix), "/")
+		if _, err := listID(ctx, client, split[0], split[1]); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		return nil
+	}
+
+	if isStars(name) {
+		name = strings.TrimPrefix(name, starsPrefix)
+	}
+
+	split := strings.Split(name, "/")
+
+	var err error
+	if len(split) == 1 || split[1] == "" {
+		_, _, err = client.Users.Get(ctx, split[0])
+	} else {
+		repo := strings.SplitN(split[1], "@", 2)[0]
+		_, _, err = client.Repositories.Get(ctx, split[0], repo)
+	}
+
+	if e, ok := err.(*github.ErrorResponse); ok &&
+		e.Response.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s does not exist", name)
+	}
+	return err
+}
+
+func discoverRepos(client *github.Client, base string, in query, out chan<- dl, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	ctx := context.Background()
 	opt := &github.SearchOptions{
-		ListOptions: github.ListOptions{PerPage: 100},
+		ListOptions: github.ListOptions{
+			Page:    cursor(in.owner),
+			PerPage: 100,
+		},
+	}
+	if opt.Page != 0 {
+		msgs <- msg{
+			s: fmt.Sprintf("resuming discovery of %s at page %d",
+				in.owner, opt.Page),
+			v: true,
+		}
 	}
 	query := fmt.Sprintf(`user:"%s"`, in.owner)
+	pages := &pageCursors{owner: in.owner}
+	var count uint64
+	for page := range searchPages(ctx, client, query, opt) {
+		// Repos of earlier pages are still downloaded
+		if page.err != nil {
+			msgs <- fmt.Errorf("%s: %v", in.owner, page.err)
+			break
+		}
+		if page.result.Incomplete {
+			msgs <- fmt.Errorf("%s: search results of page %d are incomplete, "+
+				"some repos may be missing", in.owner, page.page)
+		}
+		p := pages.page(page.next)
+		for i := range page.result.Repositories {
+			if queueFound(client, base, in, &page.result.Repositories[i], p, out, wg) {
+				count++
+			}
+		}
+		p.done()
+	}
+
+	msgs <- msg{
+		s: fmt.Sprintf("found %d repos for %s", count, in.owner),
+		v: false,
+	}
+	atomic.AddUint64(&total, count)
+}
+
+// discoverOrgRepos is discoverRepos for an organization, whose repos are
+// listed rather than searched for. Unlike searches, listing is not capped at a
+// thousand results.
+func discoverOrgRepos(client *github.Client, base string, in query, out chan<- dl, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ctx := context.Background()
+	opt := &github.ListOptions{
+		Page:    cursor(in.owner),
+		PerPage: 100,
+	}
+	if opt.Page != 0 {
+		msgs <- msg{
+			s: fmt.Sprintf("resuming discovery of %s at page %d",
+				in.owner, opt.Page),
+			v: true,
+		}
+	}
+	pages := &pageCursors{owner: in.owner}
 	var count uint64
 	for {
-		result, resp, err := client.Search.Repositories(ctx, query, opt)
+		repos, resp, err := listOrgRepos(ctx, client, in.owner, opt)
 		if err != nil {
-			log.Fatal(err)
-		}
-		count += uint64(len(result.Repositories))
-		wg.Add(len(result.Repositories))
-		for _, r := range result.Repositories {
-			out <- dl{
-				git:      *r.GitURL,
-				ssh:      *r.SSHURL,
-				fullname: *r.FullName,
-				owner:    in.owner,
-				private:  *r.Private,
+			msgs <- fmt.Errorf("%s: %v", in.owner, err)
+			break
+		}
+
+		p := pages.page(resp.NextPage)
+		for i := range repos {
+			if queueFound(client, base, in, &repos[i], p, out, wg) {
+				count++
 			}
 		}
+		p.done()
+
 		if resp.NextPage == 0 {
 			break
 		}
 		opt.Page = resp.NextPage
-		time.Sleep(sleep)
+		pause()
 	}
 
 	msgs <- msg{
@@ -120,6 +409,268 @@ func discoverRepos(client *github.Client, in query, out chan<- dl, wg *sync.Wait
 	atomic.AddUint64(&total, count)
 }
 
+// queueFound queues a repo discovered for in on page p, if any, along with its
+// parent with -with-parents, reporting whether it was queued. The parent is
+// counted separately.
+func queueFound(client *github.Client, base string, in query, r *repository, p *cursorPage, out chan<- dl, wg *sync.WaitGroup) bool {
+	if !in.filter.visible(r.GetFullName(), r.visibility()) ||
+		!in.filter.speaks(r.GetFullName(), r.GetLanguage()) ||
+		!queue(r.GetFullName()) {
+		return false
+	}
+
+	d := newDl(&r.Repository, in.owner, in.filter)
+	if p != nil {
+		p.add()
+		d.page = p
+	}
+	wg.Add(1)
+	out <- d
+
+	if parents && r.GetFork() {
+		// Search results and renamed owners may differ from in.owner
+		full, _, err := getRepo(context.Background(), client,
+			r.GetOwner().GetLogin(), r.GetName())
+		if err != nil {
+			msgs <- err
+		} else if full.Parent != nil {
+			queueParent(base, full.Parent, r.GetFullName(), in.filter, out, wg)
+		}
+	}
+	return true
+}
+
+// searchPage is a page of search results, with the numbers of the next page,
+// or 0 after the last one, and of the last page, if known.
+type searchPage struct {
+	page   int
+	result *repoSearch
+	next   int
+	last   int
+	err    error
+}
+
+// searchPages returns the pages of a repo search from opt.Page on, in order.
+// Pages with incomplete results are retried up to searchRetries times.
+// Once the first page tells how many there are, the rest are fetched
+// concurrently, by up to pageWorkers at a time. The channel ends after the last
+// page or the first error, once every fetch has stopped.
+func searchPages(ctx context.Context, client *github.Client, query string, opt *github.SearchOptions) <-chan searchPage {
+	out := make(chan searchPage)
+
+	fetch := func(page int) searchPage {
+		o := *opt
+		o.Page = page
+
+		// The search times out with partial results on GitHub's side
+		for i := 1; ; i++ {
+			result, resp, err := searchRepos(ctx, client, query, &o)
+			if err != nil {
+				return searchPage{err: err}
+			}
+
+			if !result.Incomplete || i == searchRetries {
+				return searchPage{
+					page:   page,
+					result: result,
+					next:   resp.NextPage,
+					last:   resp.LastPage,
+				}
+			}
+			pause()
+		}
+	}
+
+	go func() {
+		// Workers left after an error are stopped, and all of them finish
+		// before the channel ends
+		ctx, cancel := context.WithCancel(ctx)
+		var workers sync.WaitGroup
+		defer close(out)
+		defer workers.Wait()
+		defer cancel()
+
+		first := opt.Page
+		if first == 0 {
+			first = 1
+		}
+
+		p := fetch(first)
+		out <- p
+
+		for p.err == nil && p.next != 0 {
+			first, last := p.next, p.last
+			if last < first {
+				last = first
+			}
+
+			pages := make([]chan searchPage, last-first+1)
+			for i := range pages {
+				pages[i] = make(chan searchPage, 1)
+			}
+
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				sem := make(chan struct{}, pageWorkers)
+				for i := range pages {
+					select {
+					case sem <- struct{}{}:
+					case <-ctx.Done():
+						return
+					}
+
+					workers.Add(1)
+					go func(i int) {
+						defer workers.Done()
+						pages[i] <- fetch(first + i)
+						if ctx.Err() == nil {
+							pause()
+						}
+						<-sem
+					}(i)
+				}
+			}()
+
+			for _, c := range pages {
+				p = <-c
+				out <- p
+				if p.err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	return out
+}
+
+// queueParent queues the parent of a fork for download.
+func queueParent(base string, parent *github.Repository, fork string, f *filter, out chan<- dl, wg *sync.WaitGroup) {
+	vis := (&repository{Repository: *parent}).visibility()
+	if !f.visible(parent.GetFullName(), vis) ||
+		!f.speaks(parent.GetFullName(), parent.GetLanguage()) ||
+		!queue(parent.GetFullName()) {
+		return
+	}
+
+	owner := parent.GetOwner().GetLogin()
+	if err := mkdir(base, owner); err != nil {
+		msgs <- err
+		return
+	}
+
+	wg.Add(1)
+	atomic.AddUint64(&total, 1)
+	out <- newDl(parent, owner, f)
+
+	msgs <- msg{
+		s: fmt.Sprintf("added parent %s of fork %s", parent.GetFullName(), fork),
+		v: true,
+	}
+}
+
+// queue marks a repo as queued for download, reporting whether it was not
+// already queued.
+func queue(fullname string) bool {
+	key := strings.ToLower(fullname)
+
+	queuedMu.Lock()
+	defer queuedMu.Unlock()
+
+	if queued[key] {
+		return false
+	}
+
+	queued[key] = true
+	return true
+}
+
+func isOrg(ctx context.Context, client *github.Client, owner string) (bool, error) {
+	for {
+		user, _, err := client.Users.Get(ctx, owner)
+		if waitRateLimit(err) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		return user.GetType() == "Organization", nil
+	}
+}
+
+// ownerIsOrg reports whether an owner's repos are listed as an organization's,
+// by -k or, with -k auto, by the owner's account type.
+func ownerIsOrg(ctx context.Context, client *github.Client, owner string) bool {
+	switch ownerKind {
+	case "user":
+		return false
+	case "org":
+		return true
+	}
+
+	org, err := isOrg(ctx, client, owner)
+	if err != nil {
+		msgs <- fmt.Errorf("%s: %v, searching its repos as a user's", owner, err)
+	}
+	return org
+}
+
+// queryOrgs queues the repos of every organization the user in.owner belongs
+// to.
+func queryOrgs(client *github.Client, base string, in query, out chan<- dl, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	orgs, err := userOrgs(context.Background(), client, in.owner)
+	if err != nil {
+		msgs <- fmt.Errorf("%s: organizations: %v", in.owner, err)
+		return
+	}
+
+	msgs <- msg{
+		s: fmt.Sprintf("found %d organizations for %s", len(orgs), in.owner),
+		v: false,
+	}
+
+	for _, org := range orgs {
+		wg.Add(1)
+		queryOwner(client, base, query{
+			kind:   queryUser,
+			owner:  org,
+			filter: in.filter,
+			org:    true,
+		}, out, wg)
+	}
+}
+
+// userOrgs returns the organizations a user belongs to. Only public
+// memberships are visible, except to the user themself.
+func userOrgs(ctx context.Context, client *github.Client, owner string) ([]string, error) {
+	user := owner
+	if self, _, err := client.Users.Get(ctx, ""); err == nil &&
+		strings.EqualFold(self.GetLogin(), owner) {
+		user = ""
+	}
+
+	var orgs []string
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.Organizations.List(ctx, user, opt)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, o := range page {
+			orgs = append(orgs, o.GetLogin())
+		}
+
+		if resp.NextPage == 0 {
+			return orgs, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
 func mkdir(base, name string) error {
 	err := os.Mkdir(filepath.Join(base, name), 0700)
 	if err == nil || os.IsExist(err) {
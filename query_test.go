@@ -0,0 +1,280 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// discover runs q and returns the sorted full names of the repos it queued.
+func discover(t *testing.T, client *github.Client, q query) []string {
+	t.Helper()
+
+	dls := make(chan dl, 100)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	queryOwner(client, t.TempDir(), q, dls, &wg)
+	close(dls)
+
+	var names []string
+	for d := range dls {
+		names = append(names, d.fullname)
+		wg.Done()
+	}
+	wg.Wait()
+
+	sort.Strings(names)
+	return names
+}
+
+func TestDiscoverUserPaginates(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+
+	f, client := newFakeGitHub(t)
+	var pages [][]map[string]interface{}
+	var want []string
+	for p := 0; p < 3; p++ {
+		var page []map[string]interface{}
+		for i := 0; i < 2; i++ {
+			name := "r" + strconv.Itoa(2*p+i)
+			page = append(page, testRepo("x", name, "file:///none"))
+			want = append(want, "x/"+name)
+		}
+		pages = append(pages, page)
+	}
+	f.handleOwner("x", "User", pages...)
+
+	got := discover(t, client, query{kind: queryUser, owner: "x", filter: &filter{}})
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+	if total != uint64(len(want)) {
+		t.Errorf("total %d, want %d", total, len(want))
+	}
+}
+
+func TestDiscoverOrgLists(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+
+	f, client := newFakeGitHub(t)
+	f.handleOwner("o", "Organization",
+		[]map[string]interface{}{testRepo("o", "a", "file:///none")},
+		[]map[string]interface{}{testRepo("o", "b", "file:///none")})
+
+	got := discover(t, client, query{kind: queryUser, owner: "o", filter: &filter{}})
+	if want := []string{"o/a", "o/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+}
+
+func TestDiscoverFilters(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+
+	goRepo := testRepo("x", "go", "file:///none")
+	goRepo["language"] = "Go"
+	cRepo := testRepo("x", "c", "file:///none")
+	cRepo["language"] = "C"
+	private := testRepo("x", "private", "file:///none")
+	private["language"] = "go"
+	private["private"] = true
+	none := testRepo("x", "none", "file:///none")
+
+	f, client := newFakeGitHub(t)
+	f.handleOwner("x", "User",
+		[]map[string]interface{}{goRepo, cRepo, private, none})
+
+	filt := &filter{
+		langs:      map[string]bool{"go": true},
+		visibility: map[string]bool{"public": true},
+	}
+	got := discover(t, client, query{kind: queryUser, owner: "x", filter: filt})
+	if want := []string{"x/go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+	if total != 1 {
+		t.Errorf("total %d, want 1", total)
+	}
+}
+
+func TestDiscoverWaitsForRateLimit(t *testing.T) {
+	resetGlobals(t)
+	stop := testMsgs(t)
+
+	f, client := newFakeGitHub(t)
+
+	var limited int32
+	f.mux.HandleFunc("/users/x", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.CompareAndSwapInt32(&limited, 0, 1) {
+			reset := time.Now().Add(time.Second).Unix()
+			w.Header().Set("X-RateLimit-Limit", "60")
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset, 10))
+			writeTestJSON(w, http.StatusForbidden, map[string]string{
+				"message": "API rate limit exceeded for 127.0.0.1.",
+			})
+			return
+		}
+		writeTestJSON(w, http.StatusOK, map[string]string{
+			"login": "x",
+			"type":  "Organization",
+		})
+	})
+	f.mux.HandleFunc("/orgs/x/repos", func(w http.ResponseWriter, r *http.Request) {
+		writeTestJSON(w, http.StatusOK, repoList([]map[string]interface{}{
+			testRepo("x", "a", "file:///none"),
+		}))
+	})
+
+	got := discover(t, client, query{kind: queryUser, owner: "x", filter: &filter{}})
+	if want := []string{"x/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+
+	waited := false
+	for _, m := range stop() {
+		if m, ok := m.(msg); ok && strings.HasPrefix(m.s, "API rate limited") {
+			waited = true
+		}
+	}
+	if !waited {
+		t.Error("rate limit not waited for")
+	}
+}
+
+// activeTransport counts the requests in flight.
+type activeTransport struct {
+	n int32
+}
+
+func (a *activeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&a.n, 1)
+	defer atomic.AddInt32(&a.n, -1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestSearchPagesStopsAfterError(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+
+	f, client := newFakeGitHub(t)
+	f.mux.HandleFunc("/failing/search/repositories", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "", "1":
+			u := f.URL + r.URL.Path + "?page="
+			w.Header().Set("Link", `<`+u+`2>; rel="next", <`+u+`8>; rel="last"`)
+			writeTestJSON(w, http.StatusOK, searchResult(nil))
+		case "2":
+			writeTestJSON(w, http.StatusInternalServerError,
+				map[string]string{"message": "boom"})
+		default:
+			time.Sleep(100 * time.Millisecond)
+			writeTestJSON(w, http.StatusOK, searchResult(nil))
+		}
+	})
+
+	active := &activeTransport{}
+	c := github.NewClient(&http.Client{Transport: active})
+	c.BaseURL, _ = client.BaseURL.Parse("/failing/")
+
+	var errs int
+	opt := &github.SearchOptions{}
+	for p := range searchPages(context.Background(), c, "q", opt) {
+		if p.err != nil {
+			errs++
+		}
+	}
+	if errs != 1 {
+		t.Errorf("%d pages failed, want 1", errs)
+	}
+	if n := atomic.LoadInt32(&active.n); n != 0 {
+		t.Errorf("%d requests still running after the pages ended", n)
+	}
+}
+
+// TestDiscoverParentsOfListedOwner checks that -with-parents looks up a fork by
+// the owner GitHub lists it under, not the one it was queried with.
+func TestDiscoverParentsOfListedOwner(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+	parents = true
+
+	f, client := newFakeGitHub(t)
+	fork := testRepo("y", "a", "file:///none")
+	fork["fork"] = true
+	f.handleOwner("x", "User", []map[string]interface{}{fork})
+
+	full := testRepo("y", "a", "file:///none")
+	full["parent"] = testRepo("z", "p", "file:///none")
+	f.handleJSON("/repos/y/a", full)
+
+	got := discover(t, client, query{kind: queryUser, owner: "x", filter: &filter{}})
+	if want := []string{"y/a", "z/p"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+}
+
+func TestDiscoverRenamedRepo(t *testing.T) {
+	for _, follows := range []bool{false, true} {
+		follows := follows
+		t.Run(fmt.Sprintf("follow=%t", follows), func(t *testing.T) {
+			resetGlobals(t)
+			testMsgs(t)
+			follow = follows
+
+			f, client := newFakeGitHub(t)
+			f.handleJSON("/repos/x/old", testRepo("y", "new", "file:///none"))
+
+			dls := make(chan dl, 10)
+			var wg sync.WaitGroup
+			wg.Add(1)
+			queryOwner(client, t.TempDir(), query{kind: queryRepo, owner: "x",
+				repo: "old", filter: &filter{}}, dls, &wg)
+			close(dls)
+
+			// The repo keeps the owner it was named with, unless followed
+			want := "x y/new"
+			if follows {
+				want = "y y/new"
+			}
+			var got []string
+			for d := range dls {
+				got = append(got, d.owner+" "+d.fullname)
+				wg.Done()
+			}
+			if len(got) != 1 || got[0] != want {
+				t.Errorf("queued %v, want [%s]", got, want)
+			}
+		})
+	}
+}
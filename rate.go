@@ -0,0 +1,202 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// Times a request is retried after pausing for a secondary rate limit.
+const throttleRetries = 3
+
+var (
+	// Latest reset of the API rate limit reported as waited for
+	limitReset   time.Time
+	limitResetMu sync.Mutex
+)
+
+// Tokens for -rate, added at a steady rate. Nil without -rate.
+var bucket chan struct{}
+
+// startBucket starts adding tokens to the bucket at rate per second, kept
+// between minRate and maxRate.
+func startBucket(rate float64) {
+	b := make(chan struct{}, 1)
+	bucket = b
+
+	every := float64(time.Second) / maxRate
+	if d := float64(time.Second) / rate; d > every {
+		every = math.Min(d, float64(time.Second)/minRate)
+	}
+
+	go func() {
+		t := time.NewTicker(time.Duration(every))
+		for range t.C {
+			select {
+			case b <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
+
+// pace waits before starting a clone: with -rate until a token is available,
+// otherwise for a fixed time.
+func pace() {
+	if bucket != nil {
+		<-bucket
+		return
+	}
+	time.Sleep(interval)
+}
+
+// pause waits between API queries, unless -rate already limits them.
+func pause() {
+	if bucket == nil {
+		time.Sleep(interval)
+	}
+}
+
+// rateTransport takes a token from the bucket before each request.
+type rateTransport struct {
+	base http.RoundTripper
+}
+
+func (t rateTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	<-bucket
+	return t.base.RoundTrip(r)
+}
+
+// throttleTransport pauses every request for as long as the API asks, with
+// Retry-After, when it rejects a request for a secondary rate limit.
+type throttleTransport struct {
+	base http.RoundTripper
+
+	mu     sync.Mutex
+	resume time.Time
+}
+
+func (t *throttleTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	for i := 0; ; i++ {
+		t.mu.Lock()
+		wait := time.Until(t.resume)
+		t.mu.Unlock()
+		time.Sleep(wait)
+
+		resp, err := t.base.RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+
+		after := resp.Header.Get("Retry-After")
+		if resp.StatusCode != http.StatusForbidden &&
+			resp.StatusCode != http.StatusTooManyRequests || after == "" {
+			return resp, nil
+		}
+
+		sec, err := strconv.Atoi(after)
+		if err != nil {
+			return resp, nil
+		}
+
+		d := time.Duration(sec) * time.Second
+		t.mu.Lock()
+		if resume := time.Now().Add(d); resume.After(t.resume) {
+			t.resume = resume
+			msgs <- msg{
+				s: fmt.Sprintf("API throttled, pausing all requests for %s", d),
+				v: false,
+			}
+		}
+		t.mu.Unlock()
+
+		// Requests with a body cannot be sent again
+		if i == throttleRetries || r.Body != nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
+
+// waitRateLimit reports whether err is the API rate limit running out, and if
+// so, waits until it resets so the request can be retried. Resets further away
+// than -max-wait are reported instead.
+func waitRateLimit(err error) bool {
+	e, ok := err.(*github.RateLimitError)
+	if !ok {
+		return false
+	}
+
+	reset := e.Rate.Reset.Time
+	wait := time.Until(reset)
+	if wait > maxWait {
+		msgs <- fmt.Errorf("API rate limited, resets at %s, after -max-wait",
+			reset.Format(time.RFC3339))
+		return false
+	}
+
+	limitResetMu.Lock()
+	if reset.After(limitReset) {
+		limitReset = reset
+		msgs <- msg{
+			s: fmt.Sprintf("API rate limited, waiting until %s",
+				reset.Format(time.RFC3339)),
+			v: false,
+		}
+	}
+	limitResetMu.Unlock()
+
+	// The reset time is only accurate to the second
+	time.Sleep(wait + time.Second)
+	return true
+}
+
+// proxyTransport returns the transport of HTTP requests, through -socks5 if set.
+func proxyTransport() http.RoundTripper {
+	if socks5 == "" {
+		return http.DefaultTransport
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyURL(&url.URL{Scheme: "socks5", Host: socks5})
+	return t
+}
+
+// httpClient returns the HTTP client underlying API requests.
+func httpClient() *http.Client {
+	rt := proxyTransport()
+
+	if bucket != nil {
+		rt = rateTransport{rt}
+	}
+
+	if throttle {
+		rt = &throttleTransport{base: rt}
+	}
+
+	return &http.Client{Transport: rt}
+}
@@ -0,0 +1,42 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// TestStartBucketExtremes checks that rates beyond what the ticker can take
+// are kept in range instead of panicking.
+func TestStartBucketExtremes(t *testing.T) {
+	t.Cleanup(func() { bucket = nil })
+
+	for _, rate := range []float64{1e10, math.Inf(1), math.NaN(), 1e-10} {
+		startBucket(rate)
+	}
+
+	startBucket(1e10)
+	select {
+	case <-bucket:
+	case <-time.After(time.Second):
+		t.Error("no token from the fastest bucket")
+	}
+}
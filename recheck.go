@@ -0,0 +1,234 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/github"
+)
+
+var (
+	// Repos downloaded or deliberately skipped, by lowercase full name, with
+	// -recheck
+	accounted   = make(map[string]bool)
+	accountedMu sync.Mutex
+
+	// Work directory of the repos downloaded, by lowercase full name, or ""
+	// for those already archived by -pipeline, with -recheck
+	downloaded = make(map[string]string)
+)
+
+// account notes that a repo was downloaded, or skipped on purpose, such as by a
+// filter.
+func account(fullname string) {
+	if !recheck {
+		return
+	}
+
+	accountedMu.Lock()
+	accounted[strings.ToLower(fullname)] = true
+	accountedMu.Unlock()
+}
+
+// accountDownload notes that a repo was downloaded into dir, which the recheck
+// makes sure is still there.
+func accountDownload(fullname, dir string) {
+	if !recheck {
+		return
+	}
+
+	accountedMu.Lock()
+	accounted[strings.ToLower(fullname)] = true
+	downloaded[strings.ToLower(fullname)] = dir
+	accountedMu.Unlock()
+}
+
+// present reports whether a repo was downloaded or skipped on purpose, and if
+// it was downloaded, is still in the work directory. accountedMu must be held.
+func present(fullname string) bool {
+	key := strings.ToLower(fullname)
+	if !accounted[key] {
+		return false
+	}
+
+	dir, ok := downloaded[key]
+	if !ok || dir == "" {
+		return true
+	}
+	_, err := os.Stat(dir)
+	return err == nil
+}
+
+// recheckRepos queries the API again for the repos of every target and reports
+// those that were neither downloaded nor skipped on purpose, or whose download
+// is no longer in the work directory. It returns how many are missing.
+func recheckRepos(client *github.Client, targets []target) int {
+	ctx := context.Background()
+	missing := make(map[string]bool)
+
+	for _, t := range targets {
+		names, err := targetRepos(ctx, client, t)
+		if err != nil {
+			msgs <- fmt.Errorf("recheck %s: %v", t.name, err)
+			continue
+		}
+
+		accountedMu.Lock()
+		for _, n := range names {
+			if !present(n) && !t.filter.excluded(n) {
+				missing[n] = true
+			}
+		}
+		accountedMu.Unlock()
+	}
+
+	names := make([]string, 0, len(missing))
+	for n := range missing {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	for _, n := range names {
+		msgs <- fmt.Errorf("%s: found by recheck but not downloaded", n)
+	}
+	return len(names)
+}
+
+// targetRepos returns the full names of the repos a target currently names,
+// of the visibilities its filter keeps.
+func targetRepos(ctx context.Context, client *github.Client, t target) ([]string, error) {
+	if isLocal(t.name) {
+		return nil, nil
+	}
+
+	if isList(t.name) {
+		split := strings.Split(strings.TrimPrefix(t.name, listPrefix), "/")
+		id, err := listID(ctx, client, split[0], split[1])
+		if err != nil {
+			return nil, err
+		}
+		return listRepos(ctx, client, id)
+	}
+
+	if isStars(t.name) {
+		repos, err := starredRepos(ctx, client,
+			strings.TrimPrefix(t.name, starsPrefix))
+		if err != nil {
+			return nil, err
+		}
+		var names []string
+		for _, r := range repos {
+			vis := (&repository{Repository: *r}).visibility()
+			if visibleTo(t.filter, vis) {
+				names = append(names, r.GetFullName())
+			}
+		}
+		return names, nil
+	}
+
+	split := strings.Split(t.name, "/")
+	if len(split) == 2 && split[1] != "" {
+		repo := strings.SplitN(split[1], "@", 2)[0]
+		r, _, err := getRepo(ctx, client, split[0], repo)
+		if err != nil {
+			return nil, err
+		}
+		if !visibleTo(t.filter, r.visibility()) {
+			return nil, nil
+		}
+		return []string{r.GetFullName()}, nil
+	}
+
+	repos, err := ownerRepos(ctx, client, split[0],
+		ownerIsOrg(ctx, client, split[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(split) == 2 {
+		orgs, err := userOrgs(ctx, client, split[0])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, org := range orgs {
+			more, err := ownerRepos(ctx, client, org, true)
+			if err != nil {
+				return nil, err
+			}
+			repos = append(repos, more...)
+		}
+	}
+
+	var names []string
+	for _, r := range repos {
+		if visibleTo(t.filter, r.visibility()) {
+			names = append(names, r.GetFullName())
+		}
+	}
+	return names, nil
+}
+
+// ownerRepos returns the repos of an owner, listed for an organization and
+// searched for otherwise, as during discovery.
+func ownerRepos(ctx context.Context, client *github.Client, owner string, org bool) ([]repository, error) {
+	var repos []repository
+
+	if org {
+		opt := &github.ListOptions{PerPage: 100}
+		for {
+			page, resp, err := listOrgRepos(ctx, client, owner, opt)
+			if err != nil {
+				return nil, err
+			}
+			repos = append(repos, page...)
+
+			if resp.NextPage == 0 {
+				return repos, nil
+			}
+			opt.Page = resp.NextPage
+			pause()
+		}
+	}
+
+	opt := &github.SearchOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	query := fmt.Sprintf(`user:"%s"`, owner)
+
+	for page := range searchPages(ctx, client, query, opt) {
+		if page.err != nil {
+			return nil, page.err
+		}
+		repos = append(repos, page.result.Repositories...)
+	}
+	return repos, nil
+}
+
+// visibleTo reports whether a filter keeps repos of a visibility, without the
+// reporting of -filters-warn-only.
+func visibleTo(f *filter, visibility string) bool {
+	return f.visibility == nil || f.visibility[visibility]
+}
@@ -0,0 +1,134 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// writeReleases downloads the assets of every release of a repo into
+// releases/<tag> in its clone, unless the repo has its own releases path.
+// Assets left by an earlier run in the work directory are replaced. A release
+// without assets gets no directory, and an asset that cannot be downloaded is
+// reported and skipped.
+func writeReleases(ctx context.Context, client *github.Client, dir string, in dl) error {
+	if err := clearSubdir(ctx, dir, releaseDir); err != nil {
+		return err
+	}
+
+	var all []*github.RepositoryRelease
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.Repositories.ListReleases(ctx, in.login,
+			in.name, opt)
+		if err != nil {
+			return err
+		}
+		all = append(all, page...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+
+	hc := httpClient()
+	for _, r := range all {
+		if len(r.Assets) == 0 {
+			continue
+		}
+
+		// Drafts may not have a tag yet
+		name := r.GetTagName()
+		if name == "" {
+			name = strconv.FormatInt(r.GetID(), 10)
+		}
+		sub := filepath.Join(dir, releaseDir, safeName(name))
+		if err := os.MkdirAll(sub, 0700); err != nil {
+			return err
+		}
+
+		for _, a := range r.Assets {
+			path := filepath.Join(sub, safeName(a.GetName()))
+			if err := downloadAsset(ctx, client, hc, in, a.GetID(), path); err != nil {
+				msgs <- fmt.Errorf("%s: release %s: asset %s: %v", in.fullname,
+					name, a.GetName(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// downloadAsset saves a release asset to path, following the redirect to
+// where GitHub stores it with hc.
+func downloadAsset(ctx context.Context, client *github.Client, hc *http.Client, in dl, id int64, path string) error {
+	rc, redirect, err := client.Repositories.DownloadReleaseAsset(ctx,
+		in.login, in.name, id)
+	if err != nil {
+		return err
+	}
+
+	if redirect != "" {
+		req, err := http.NewRequest(http.MethodGet, redirect, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := hc.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("download returned %s", resp.Status)
+		}
+		rc = resp.Body
+	}
+	defer rc.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, rc); err != nil {
+		_ = f.Close()
+		_ = os.Remove(path)
+		return err
+	}
+
+	return f.Close()
+}
+
+// safeName turns a tag or asset name into a single path element.
+func safeName(s string) string {
+	s = strings.Replace(s, "/", "_", -1)
+	s = strings.Replace(s, "\\", "_", -1)
+	if s == "." || s == ".." {
+		s = "_" + s
+	}
+	return s
+}
@@ -0,0 +1,146 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// Accept header of repo requests, asking for topics and, on GitHub Enterprise,
+// visibility.
+const repoMediaType = "application/vnd.github.mercy-preview+json, " +
+	"application/vnd.github.nebula-preview+json"
+
+// repository is a GitHub repo along with its visibility, which go-github does
+// not decode.
+type repository struct {
+	github.Repository
+	Visibility *string `json:"visibility,omitempty"`
+}
+
+// repoSearch is a page of repository search results.
+type repoSearch struct {
+	Total        int          `json:"total_count"`
+	Incomplete   bool         `json:"incomplete_results"`
+	Repositories []repository `json:"items"`
+}
+
+// visibility returns whether a repo is public, internal, or private. Servers
+// without the visibility field only tell public and private repos apart.
+func (r *repository) visibility() string {
+	if r.Visibility != nil && *r.Visibility != "" {
+		return strings.ToLower(*r.Visibility)
+	}
+	if r.GetPrivate() {
+		return "private"
+	}
+	return "public"
+}
+
+// do is client.Do, waiting out the API rate limit for up to -max-wait.
+func do(ctx context.Context, client *github.Client, req *http.Request, v interface{}) (*github.Response, error) {
+	for {
+		resp, err := client.Do(ctx, req, v)
+		if !waitRateLimit(err) {
+			return resp, err
+		}
+
+		if err := rewind(req); err != nil {
+			return resp, err
+		}
+	}
+}
+
+// rewind resets the body of a request to send it again, such as a GraphQL
+// query retried after the rate limit.
+func rewind(req *http.Request) error {
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	req.Body = body
+	return err
+}
+
+// searchRepos is client.Search.Repositories, keeping visibility.
+func searchRepos(ctx context.Context, client *github.Client, query string, opt *github.SearchOptions) (*repoSearch, *github.Response, error) {
+	u := fmt.Sprintf("search/repositories?q=%s&per_page=%d",
+		url.QueryEscape(query), opt.PerPage)
+	if opt.Page != 0 {
+		u += fmt.Sprintf("&page=%d", opt.Page)
+	}
+
+	req, err := client.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", repoMediaType)
+
+	result := new(repoSearch)
+	resp, err := do(ctx, client, req, result)
+	if err != nil {
+		return nil, resp, err
+	}
+	return result, resp, nil
+}
+
+// getRepo is client.Repositories.Get, keeping visibility.
+func getRepo(ctx context.Context, client *github.Client, owner, name string) (*repository, *github.Response, error) {
+	req, err := client.NewRequest("GET", fmt.Sprintf("repos/%v/%v", owner,
+		name), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", repoMediaType)
+
+	repo := new(repository)
+	resp, err := do(ctx, client, req, repo)
+	if err != nil {
+		return nil, resp, err
+	}
+	return repo, resp, nil
+}
+
+// listOrgRepos is client.Repositories.ListByOrg for every type of repo,
+// keeping visibility.
+func listOrgRepos(ctx context.Context, client *github.Client, org string, opt *github.ListOptions) ([]repository, *github.Response, error) {
+	u := fmt.Sprintf("orgs/%v/repos?type=all&per_page=%d", org, opt.PerPage)
+	if opt.Page != 0 {
+		u += fmt.Sprintf("&page=%d", opt.Page)
+	}
+
+	req, err := client.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Accept", repoMediaType)
+
+	var repos []repository
+	resp, err := do(ctx, client, req, &repos)
+	if err != nil {
+		return nil, resp, err
+	}
+	return repos, resp, nil
+}
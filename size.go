@@ -0,0 +1,69 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeSuffixes = []struct {
+	suffix string
+	scale  int64
+}{
+	{"K", 1 << 10},
+	{"M", 1 << 20},
+	{"G", 1 << 30},
+	{"T", 1 << 40},
+}
+
+// parseSize parses a positive byte count with an optional binary K, M, G, or T
+// suffix, such as "4G".
+func parseSize(s string) (int64, error) {
+	scale := int64(1)
+	num := strings.ToUpper(s)
+
+	for _, x := range sizeSuffixes {
+		if strings.HasSuffix(num, x.suffix) {
+			num = strings.TrimSuffix(num, x.suffix)
+			scale = x.scale
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 || n > (1<<63-1)/scale {
+		return 0, errors.New("invalid size")
+	}
+
+	return n * scale, nil
+}
+
+// formatSize formats a byte count using the largest suffix parseSize accepts
+// that keeps it at least 1.
+func formatSize(n uint64) string {
+	for i := len(sizeSuffixes) - 1; i >= 0; i-- {
+		if x := sizeSuffixes[i]; n >= uint64(x.scale) {
+			return fmt.Sprintf("%.1f%s", float64(n)/float64(x.scale), x.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", n)
+}
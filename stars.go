@@ -0,0 +1,95 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/go-github/github"
+)
+
+// Starred repos of a user are named as stars:user.
+const starsPrefix = "stars:"
+
+// isStars reports whether arg names the starred repos of a user.
+func isStars(arg string) bool {
+	return strings.HasPrefix(arg, starsPrefix)
+}
+
+// discoverStarred queues every repo starred by user in.owner, each under its
+// own owner.
+func discoverStarred(client *github.Client, base string, in query, out chan<- dl, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ctx := context.Background()
+	repos, err := starredRepos(ctx, client, in.owner)
+	if err != nil {
+		msgs <- fmt.Errorf("%s%s: %v", starsPrefix, in.owner, err)
+		return
+	}
+
+	var count uint64
+	for _, r := range repos {
+		owner := r.GetOwner().GetLogin()
+		if err := mkdir(base, owner); err != nil {
+			msgs <- err
+			continue
+		}
+
+		found := in
+		found.owner = owner
+		if queueFound(client, base, found, &repository{Repository: *r}, nil, out, wg) {
+			count++
+		}
+	}
+
+	msgs <- msg{
+		s: fmt.Sprintf("found %d repos starred by %s", count, in.owner),
+		v: false,
+	}
+	atomic.AddUint64(&total, count)
+}
+
+// starredRepos returns the repos starred by a user.
+func starredRepos(ctx context.Context, client *github.Client, user string) ([]*github.Repository, error) {
+	var repos []*github.Repository
+	opt := &github.ActivityListStarredOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		stars, resp, err := client.Activity.ListStarred(ctx, user, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range stars {
+			if s.Repository != nil {
+				repos = append(repos, s.Repository)
+			}
+		}
+		if resp.NextPage == 0 {
+			return repos, nil
+		}
+		opt.Page = resp.NextPage
+		pause()
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	// Next search page of every owner whose discovery was interrupted
+	cursors   = make(map[string]int)
+	cursorsMu sync.Mutex
+)
+
+// readState loads the discovery cursors of an interrupted run. A missing state
+// file is not an error.
+func readState(name string) error {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return json.NewDecoder(f).Decode(&cursors)
+}
+
+// cursor returns the search page to resume discovery of owner from.
+func cursor(owner string) int {
+	cursorsMu.Lock()
+	defer cursorsMu.Unlock()
+	return cursors[strings.ToLower(owner)]
+}
+
+// saveCursor records the next search page of owner, or forgets the owner when
+// page is 0, and rewrites the state file.
+func saveCursor(owner string, page int) error {
+	if stateFile == "" {
+		return nil
+	}
+
+	cursorsMu.Lock()
+	defer cursorsMu.Unlock()
+
+	if page == 0 {
+		delete(cursors, strings.ToLower(owner))
+	} else {
+		cursors[strings.ToLower(owner)] = page
+	}
+
+	tmp := stateFile + ".tmp"
+	if err := writeJSON(tmp, cursors); err != nil {
+		return err
+	}
+	return os.Rename(tmp, stateFile)
+}
+
+// pageCursors tracks the discovered pages of an owner until every one of their
+// repos is downloaded, so the cursor saved never skips repos that were found
+// but not cloned yet.
+type pageCursors struct {
+	owner string
+	mu    sync.Mutex
+	pages []*cursorPage
+}
+
+// cursorPage is a discovered page with repos still to be downloaded.
+type cursorPage struct {
+	c    *pageCursors
+	next int
+
+	// Repos not downloaded yet, plus one until the page is fully queued
+	left int
+}
+
+// page starts tracking the page before next, in discovery order.
+func (c *pageCursors) page(next int) *cursorPage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := &cursorPage{c: c, next: next, left: 1}
+	c.pages = append(c.pages, p)
+	return p
+}
+
+// add counts a repo of the page queued for download.
+func (p *cursorPage) add() {
+	p.c.mu.Lock()
+	p.left++
+	p.c.mu.Unlock()
+}
+
+// done marks a repo of the page downloaded, or once all of them are queued,
+// the page itself. The cursor is saved past every page left with nothing to
+// download, up to the first page that still has.
+func (p *cursorPage) done() {
+	c := p.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p.left--
+	next := -1
+	for len(c.pages) > 0 && c.pages[0].left == 0 {
+		next = c.pages[0].next
+		c.pages = c.pages[1:]
+	}
+
+	if next < 0 {
+		return
+	}
+	if err := saveCursor(c.owner, next); err != nil {
+		msgs <- err
+	}
+}
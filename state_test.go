@@ -0,0 +1,60 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestPageCursorsWaitForDownloads checks that the cursor of an owner only
+// moves past pages whose repos, and those of every page before them, are
+// downloaded.
+func TestPageCursorsWaitForDownloads(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+	stateFile = filepath.Join(t.TempDir(), "state.json")
+
+	c := &pageCursors{owner: "x"}
+	var pages []*cursorPage
+	for _, next := range []int{2, 3, 0} {
+		p := c.page(next)
+		p.add()
+		p.done()
+		pages = append(pages, p)
+	}
+
+	check := func(want int) {
+		t.Helper()
+		cursors = make(map[string]int)
+		if err := readState(stateFile); err != nil {
+			t.Fatal(err)
+		}
+		if got := cursor("x"); got != want {
+			t.Errorf("cursor %d, want %d", got, want)
+		}
+	}
+
+	pages[1].done()
+	check(0)
+	pages[0].done()
+	check(3)
+	pages[2].done()
+	check(0)
+}
@@ -0,0 +1,202 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// Tags of a repo, by the date of the commit they point to, newest first
+const tagsQuery = `query($owner: String!, $name: String!, $first: Int!, $after: String) {
+	repository(owner: $owner, name: $name) {
+		refs(refPrefix: "refs/tags/", first: $first, after: $after,
+			orderBy: {field: TAG_COMMIT_DATE, direction: DESC}) {
+			pageInfo { hasNextPage endCursor }
+			nodes {
+				name
+				target {
+					... on Commit { committedDate }
+					... on Tag { target { ... on Commit { committedDate } } }
+				}
+			}
+		}
+	}
+}`
+
+// tagRef is a tag, with the date of the commit it points to.
+type tagRef struct {
+	name string
+	date time.Time
+}
+
+// snapshotTags shallow clones each of the latest -tags tags of a repo from url
+// into tags/<tag> of its clone. Tags that cannot be cloned are reported and
+// skipped.
+func snapshotTags(ctx context.Context, client *github.Client, in dl, dir, url string) {
+	err := clearSubdir(ctx, dir, tagDir)
+
+	var tags []string
+	if err == nil {
+		tags, err = latestTags(ctx, client, in, dir)
+	}
+	if err != nil {
+		msgs <- fmt.Errorf("%s: tags: %v", in.fullname, err)
+		return
+	}
+
+	for _, tag := range tags {
+		args := []string{"-C", dir, "clone", "-q", "--depth", "1",
+			"--branch", tag, url, filepath.Join(tagDir, filepath.FromSlash(tag))}
+		if anonymous(in) {
+			args = append([]string{"-c", "credential.helper="}, args...)
+		}
+
+		if err := run(git(ctx, args...)); err != nil {
+			msgs <- fmt.Errorf("%s: tag %s: %v", in.fullname, tag, err)
+		}
+	}
+}
+
+// latestTags returns the names of the latest -tags tags of a repo, newest
+// first. Tags of local repos and gists are ordered by date, from their clone.
+func latestTags(ctx context.Context, client *github.Client, in dl, dir string) ([]string, error) {
+	if in.local || in.gist {
+		out, err := output(git(ctx, "-C", dir, "for-each-ref",
+			"--sort=-creatordate", "--count="+strconv.Itoa(tagCount),
+			"--format=%(refname:strip=2)", "refs/tags"))
+		return strings.Fields(out), err
+	}
+
+	tags, err := newestTags(ctx, client, in, tagCount)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(tags))
+	for i, t := range tags {
+		names[i] = t.name
+	}
+	return names, nil
+}
+
+// lastTagDate returns the commit date of the repo's latest tag, the one
+// pointing to the newest commit, or the zero time if it has no tags.
+func lastTagDate(ctx context.Context, client *github.Client, in dl) (time.Time, error) {
+	tags, err := newestTags(ctx, client, in, 1)
+	if err != nil || len(tags) == 0 {
+		return time.Time{}, err
+	}
+	return tags[0].date, nil
+}
+
+// shallowSince returns the date to shallow clone a repo from with
+// -since-last-tag, or the zero time to clone its full history.
+func shallowSince(ctx context.Context, client *github.Client, in dl) (time.Time, error) {
+	if !sinceTag || in.local || in.gist {
+		return time.Time{}, nil
+	}
+
+	date, err := lastTagDate(ctx, client, in)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if date.IsZero() {
+		msgs <- msg{
+			s: fmt.Sprintf("%s has no tags, cloning full history", in.fullname),
+			v: true,
+		}
+		return date, nil
+	}
+	return date.Add(-tagContext), nil
+}
+
+// newestTags returns up to n tags of a repo, by the date of the commit they
+// point to, newest first. The REST API lists tags by name, so they are listed
+// through GraphQL.
+func newestTags(ctx context.Context, client *github.Client, in dl, n int) ([]tagRef, error) {
+	var tags []tagRef
+	var after *string
+
+	for len(tags) < n {
+		var data struct {
+			Repository *struct {
+				Refs struct {
+					PageInfo struct {
+						HasNextPage bool
+						EndCursor   string
+					}
+					Nodes []struct {
+						Name   string
+						Target struct {
+							CommittedDate time.Time
+
+							// Commit of an annotated tag
+							Target struct {
+								CommittedDate time.Time
+							}
+						}
+					}
+				}
+			}
+		}
+
+		first := n - len(tags)
+		if first > 100 {
+			first = 100
+		}
+
+		if err := graphQL(ctx, client, tagsQuery, map[string]interface{}{
+			"owner": in.login,
+			"name":  in.name,
+			"first": first,
+			"after": after,
+		}, &data); err != nil {
+			return nil, err
+		}
+
+		if data.Repository == nil {
+			return nil, fmt.Errorf("repo %s does not exist", in.fullname)
+		}
+
+		refs := data.Repository.Refs
+		for _, r := range refs.Nodes {
+			date := r.Target.CommittedDate
+			if date.IsZero() {
+				date = r.Target.Target.CommittedDate
+			}
+			tags = append(tags, tagRef{name: r.Name, date: date})
+		}
+
+		if !refs.PageInfo.HasNextPage {
+			break
+		}
+		after = &refs.PageInfo.EndCursor
+		pause()
+	}
+
+	return tags, nil
+}
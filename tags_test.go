@@ -0,0 +1,118 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// handleTags serves the tags of y/a, newest first, to the GraphQL tags query:
+// v1.9 is newer than v1.10, and annotated.
+func handleTags(t *testing.T, f *fakeGitHub) {
+	t.Helper()
+
+	tags := []map[string]interface{}{
+		{"name": "v1.9", "target": map[string]interface{}{
+			"target": map[string]string{"committedDate": "2020-01-02T03:04:05Z"},
+		}},
+		{"name": "v1.10", "target": map[string]string{
+			"committedDate": "2019-01-01T00:00:00Z",
+		}},
+	}
+
+	f.mux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Variables struct {
+				Owner string
+				Name  string
+				First int
+			}
+		}
+		v := &body.Variables
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil ||
+			v.Owner != "y" || v.Name != "a" {
+			writeTestJSON(w, http.StatusOK, map[string]interface{}{
+				"data": map[string]interface{}{"repository": nil},
+			})
+			return
+		}
+
+		nodes := tags
+		if v.First < len(nodes) {
+			nodes = nodes[:v.First]
+		}
+		writeTestJSON(w, http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{
+				"repository": map[string]interface{}{
+					"refs": map[string]interface{}{
+						"pageInfo": map[string]interface{}{"hasNextPage": false},
+						"nodes":    nodes,
+					},
+				},
+			},
+		})
+	})
+}
+
+func TestLastTagDate(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+
+	f, client := newFakeGitHub(t)
+	handleTags(t, f)
+
+	// Tags are looked up under the owner on GitHub, not the owner directory
+	in := dl{fullname: "y/a", owner: "x", login: "y", name: "a"}
+	got, err := lastTagDate(context.Background(), client, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("last tag date %v, want %v", got, want)
+	}
+}
+
+func TestLatestTagsByDate(t *testing.T) {
+	resetGlobals(t)
+	testMsgs(t)
+	defer func() { tagCount = 0 }()
+
+	f, client := newFakeGitHub(t)
+	handleTags(t, f)
+
+	in := dl{fullname: "y/a", owner: "y", login: "y", name: "a"}
+	for n, want := range map[int][]string{
+		1: {"v1.9"},
+		3: {"v1.9", "v1.10"},
+	} {
+		tagCount = n
+		got, err := latestTags(context.Background(), client, in, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("latest %d tags %v, want %v", n, got, want)
+		}
+	}
+}
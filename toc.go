@@ -0,0 +1,125 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Name of the table of contents at the root of the archive, with -tree
+const treeName = "tree.txt"
+
+// treeRepo is the entry of a repo in the table of contents.
+type treeRepo struct {
+	size uint64
+	top  map[string]bool
+}
+
+// note adds an entry of the archive, named relative to the archive root
+// before -topics, to the table of contents. Gists are listed as repos of
+// OWNER/@gists, and organization metadata is left out.
+func (a *archiver) note(name string, i os.FileInfo) {
+	split := strings.SplitN(name, "/", 5)
+	if len(split) < 2 || split[1] == orgMetaDir {
+		return
+	}
+
+	if split[1] == gistDir {
+		if len(split) < 3 {
+			return
+		}
+		split = append([]string{split[0] + "/" + gistDir}, split[2:]...)
+	}
+
+	repo := split[0] + "/" + split[1]
+	r, ok := a.tree[repo]
+	if !ok {
+		r = &treeRepo{top: make(map[string]bool)}
+		a.tree[repo] = r
+	}
+
+	if i.Mode().IsRegular() {
+		r.size += uint64(i.Size())
+	}
+
+	if len(split) == 3 {
+		top := split[2]
+		if i.IsDir() {
+			top += "/"
+		}
+		r.top[top] = true
+	}
+}
+
+// writeTree adds the table of contents, listing every repo with its size and
+// top-level contents.
+func (a *archiver) writeTree() error {
+	repos := make([]string, 0, len(a.tree))
+	for name := range a.tree {
+		repos = append(repos, name)
+	}
+	sort.Strings(repos)
+
+	var b bytes.Buffer
+	for _, name := range repos {
+		r := a.tree[name]
+		fmt.Fprintf(&b, "%s\t%s\n", name, formatSize(r.size))
+
+		top := make([]string, 0, len(r.top))
+		for t := range r.top {
+			top = append(top, t)
+		}
+		sort.Strings(top)
+
+		for _, t := range top {
+			fmt.Fprintf(&b, "\t%s\n", t)
+		}
+	}
+
+	mode := int64(0644)
+	if perm >= 0 {
+		mode = perm
+	}
+
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     treeName,
+		Mode:     mode,
+		Size:     int64(b.Len()),
+		ModTime:  time.Now(),
+	}
+
+	if tarOwner != nil {
+		hdr.Uid, hdr.Gid = tarOwner.uid, tarOwner.gid
+		hdr.Uname, hdr.Gname = tarOwner.user, tarOwner.group
+	}
+
+	if err := a.t.WriteHeader(hdr); err != nil {
+		return err
+	}
+
+	_, err := a.t.Write(b.Bytes())
+	return err
+}
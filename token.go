@@ -0,0 +1,337 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/term"
+)
+
+// Environment variable holding the access token, for runs without a terminal
+const tokenEnv = "GH_DL_TOKEN"
+
+// Rate limit headers of API responses
+const (
+	headerRemaining = "X-RateLimit-Remaining"
+	headerReset     = "X-RateLimit-Reset"
+)
+
+const (
+	// Environment variable passing the access token to tokenHelper
+	gitTokenEnv = "GH_DL_GIT_TOKEN"
+
+	// Git credential helper answering with the token in gitTokenEnv, so it
+	// never appears in URLs, command lines, errors, or the archived clones
+	tokenHelper = `!f() { test "$1" = get && echo username=x-access-token && ` +
+		`echo "password=$` + gitTokenEnv + `"; }; f`
+)
+
+// gitCredentials returns the git configuration and environment giving the
+// access token to https clones from gitHost and its gists, with -https. An
+// empty credential.helper, as for anonymous clones, still disables it.
+func gitCredentials() (config, env []string) {
+	if !httpsToken || tokenSrc == nil {
+		return nil, nil
+	}
+
+	t, err := tokenSrc.Token()
+	if err != nil {
+		return nil, nil
+	}
+
+	for _, host := range []string{gitHost, "gist." + gitHost} {
+		config = append(config, "credential.https://"+host+".helper="+tokenHelper)
+	}
+	return config, []string{gitTokenEnv + "=" + t.AccessToken}
+}
+
+// staticToken returns the source of a single access token: the content of
+// -token-file, GH_DL_TOKEN, or with -a and neither, the token entered at the
+// terminal.
+func staticToken() (oauth2.TokenSource, error) {
+	var token string
+
+	switch {
+	case tokenFile != "":
+		b, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = string(b)
+	case os.Getenv(tokenEnv) != "":
+		token = os.Getenv(tokenEnv)
+	case !term.IsTerminal(int(syscall.Stdin)):
+		return nil, errors.New("no terminal to enter the token, set " +
+			tokenEnv + " or use -token-file")
+	default:
+		fmt.Print("Personal access token: ")
+		b, err := term.ReadPassword(int(syscall.Stdin))
+		fmt.Println()
+		if err != nil {
+			return nil, err
+		}
+		token = string(b)
+	}
+
+	// Authenticating with an empty token would silently be anonymous
+	if token = strings.TrimSpace(token); token == "" {
+		return nil, errors.New("empty access token")
+	}
+
+	return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token}), nil
+}
+
+// cmdTokenSource obtains tokens by running a shell command, treating each
+// token as valid for a fixed period before running the command again.
+type cmdTokenSource struct {
+	cmd   string
+	every time.Duration
+}
+
+func (c cmdTokenSource) Token() (*oauth2.Token, error) {
+	token, err := output(exec.Command("sh", "-c", c.cmd))
+	if err != nil {
+		return nil, err
+	}
+
+	if token == "" {
+		return nil, errors.New("token command printed no token")
+	}
+
+	return &oauth2.Token{
+		AccessToken: token,
+		Expiry:      time.Now().Add(c.every),
+	}, nil
+}
+
+// rotatingTokenSource spreads requests across the rate limits of several
+// tokens. As a transport, it tracks the rate limit of each token and sends
+// every request with the least recently limited one, retrying rate limited
+// requests with another. go-github caches a single rate limit per client, so
+// responses only report the limit as exhausted once every token is.
+type rotatingTokenSource struct {
+	base   http.RoundTripper
+	mu     sync.Mutex
+	tokens []*rotatingToken
+	n      int
+}
+
+// rotatingToken is a token along with its last known rate limit.
+type rotatingToken struct {
+	token     *oauth2.Token
+	remaining int
+	reset     time.Time
+	limited   time.Time
+}
+
+// exhausted reports whether the token's rate limit is known to be used up.
+func (t *rotatingToken) exhausted(now time.Time) bool {
+	return t.remaining == 0 && now.Before(t.reset)
+}
+
+// Token returns the token requests would currently be sent with, for git.
+func (r *rotatingTokenSource) Token() (*oauth2.Token, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pick(time.Now()).token, nil
+}
+
+// transport returns r sending requests through base.
+func (r *rotatingTokenSource) transport(base http.RoundTripper) http.RoundTripper {
+	r.base = base
+	return r
+}
+
+// pick returns the token to send a request with: among tokens with requests
+// left, the least recently limited one, taking turns between equals, or the
+// one resetting first if all are exhausted. r.mu must be held.
+func (r *rotatingTokenSource) pick(now time.Time) *rotatingToken {
+	r.n++
+	var best *rotatingToken
+	for i := range r.tokens {
+		t := r.tokens[(r.n+i)%len(r.tokens)]
+		switch {
+		case best == nil:
+			best = t
+		case best.exhausted(now) != t.exhausted(now):
+			if best.exhausted(now) {
+				best = t
+			}
+		case best.exhausted(now):
+			if t.reset.Before(best.reset) {
+				best = t
+			}
+		case t.limited.Before(best.limited):
+			best = t
+		}
+	}
+	return best
+}
+
+func (r *rotatingTokenSource) RoundTrip(req *http.Request) (*http.Response, error) {
+	for i := 0; ; i++ {
+		r.mu.Lock()
+		t := r.pick(time.Now())
+		r.mu.Unlock()
+
+		sent := req.Clone(req.Context())
+		if i > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			sent.Body = body
+		}
+		t.token.SetAuthHeader(sent)
+
+		resp, err := r.base.RoundTrip(sent)
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		r.mu.Lock()
+		limited := r.update(t, resp, now)
+		left := r.left(now)
+		r.mu.Unlock()
+
+		// Requests with a body cannot be sent again without GetBody
+		retry := limited && left > 0 && i < len(r.tokens) &&
+			(req.Body == nil || req.GetBody != nil)
+		if !retry {
+			r.mu.Lock()
+			r.report(resp, now)
+			r.mu.Unlock()
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
+
+// update records the rate limit of t from resp, reporting whether resp is the
+// rate limit running out. r.mu must be held.
+func (r *rotatingTokenSource) update(t *rotatingToken, resp *http.Response, now time.Time) bool {
+	remaining, err := strconv.Atoi(resp.Header.Get(headerRemaining))
+	if err != nil {
+		return false
+	}
+	t.remaining = remaining
+
+	if sec, err := strconv.ParseInt(resp.Header.Get(headerReset), 10,
+		64); err == nil {
+		t.reset = time.Unix(sec, 0)
+	}
+
+	limited := remaining == 0 &&
+		(resp.StatusCode == http.StatusForbidden ||
+			resp.StatusCode == http.StatusTooManyRequests)
+	if limited {
+		t.limited = now
+	}
+	return limited
+}
+
+// left returns the number of tokens not known to be exhausted. r.mu must be
+// held.
+func (r *rotatingTokenSource) left(now time.Time) int {
+	n := 0
+	for _, t := range r.tokens {
+		if !t.exhausted(now) {
+			n++
+		}
+	}
+	return n
+}
+
+// report rewrites the rate limit of resp to that of all tokens together: the
+// requests left across them, and when exhausted, the first reset. r.mu must
+// be held.
+func (r *rotatingTokenSource) report(resp *http.Response, now time.Time) {
+	if resp.Header.Get(headerRemaining) == "" {
+		return
+	}
+
+	remaining := 0
+	var reset time.Time
+	for _, t := range r.tokens {
+		if t.exhausted(now) {
+			if reset.IsZero() || t.reset.Before(reset) {
+				reset = t.reset
+			}
+			continue
+		}
+		// Tokens not used yet have at least one request left
+		if t.remaining > 0 {
+			remaining += t.remaining
+		} else {
+			remaining++
+		}
+	}
+
+	resp.Header.Set(headerRemaining, strconv.Itoa(remaining))
+	if remaining == 0 {
+		resp.Header.Set(headerReset, strconv.FormatInt(reset.Unix(), 10))
+	}
+}
+
+// readTokens reads one token per line from a file, ignoring blank lines and
+// lines starting with '#'.
+func readTokens(name string) (*rotatingTokenSource, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &rotatingTokenSource{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r.tokens = append(r.tokens, &rotatingToken{
+			token:     &oauth2.Token{AccessToken: line},
+			remaining: -1,
+		})
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(r.tokens) == 0 {
+		return nil, errors.New(name + ": no tokens")
+	}
+
+	return r, nil
+}
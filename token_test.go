@@ -0,0 +1,83 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// TestRotatingTokensRetryLimited checks that a request running into one token's
+// rate limit is retried with another, and that later requests avoid the
+// limited token until it resets.
+func TestRotatingTokensRetryLimited(t *testing.T) {
+	reset := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		seen = append(seen, auth)
+		w.Header().Set(headerReset, reset)
+		if auth == "Bearer a" {
+			w.Header().Set(headerRemaining, "0")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Header().Set(headerRemaining, "10")
+	}))
+	t.Cleanup(srv.Close)
+
+	r := &rotatingTokenSource{}
+	for _, s := range []string{"a", "b"} {
+		r.tokens = append(r.tokens, &rotatingToken{
+			token:     &oauth2.Token{AccessToken: s},
+			remaining: -1,
+		})
+	}
+	hc := &http.Client{Transport: r.transport(http.DefaultTransport)}
+
+	for i := 0; i < 3; i++ {
+		resp, err := hc.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status %d, want 200", i, resp.StatusCode)
+		}
+		// Once a is known to be exhausted, only b's requests are left
+		if got := resp.Header.Get(headerRemaining); i == 2 && got != "10" {
+			t.Errorf("remaining %s, want 10", got)
+		}
+	}
+
+	limited := 0
+	for _, auth := range seen {
+		if auth == "Bearer a" {
+			limited++
+		}
+	}
+	if limited > 1 {
+		t.Errorf("limited token used %d times, want at most once: %v", limited, seen)
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ * gh-dl is a GitHub archiving client.
+ * Copyright (C) 2019 Esote
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as published
+ * by the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	webhookRetries = 3
+	webhookTimeout = 10 * time.Second
+)
+
+var (
+	// Archive files written and their SHA-256, once the archive is created
+	archived   []string
+	archiveSum string
+
+	// Errors reported during the run
+	failures []string
+
+	// Clone or update wall time of each downloaded repo, in seconds
+	cloneTimes   = make(map[string]float64)
+	cloneTimesMu sync.Mutex
+)
+
+// timeClone notes how long cloning or updating a repo took.
+func timeClone(path string, d time.Duration) {
+	cloneTimesMu.Lock()
+	cloneTimes[path] = d.Seconds()
+	cloneTimesMu.Unlock()
+}
+
+// report is the summary of a run POSTed to -webhook.
+type report struct {
+	Success    bool               `json:"success"`
+	Error      string             `json:"error,omitempty"`
+	Downloaded uint64             `json:"downloaded"`
+	Total      uint64             `json:"total"`
+	Failures   []string           `json:"failures"`
+	Archive    []string           `json:"archive"`
+	SHA256     string             `json:"sha256,omitempty"`
+	Duration   float64            `json:"duration_seconds"`
+	Clones     map[string]float64 `json:"clone_seconds"`
+}
+
+// notify POSTs the summary of a run that started at start and ended with err
+// to the webhook, retrying failed deliveries.
+func notify(url string, start time.Time, err error) error {
+	r := report{
+		Success:    err == nil,
+		Downloaded: successful,
+		Total:      total,
+		Failures:   failures,
+		Archive:    archived,
+		SHA256:     archiveSum,
+		Duration:   time.Since(start).Seconds(),
+		Clones:     cloneTimes,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	// Deliveries go through -socks5, but are not paced like API requests
+	client := &http.Client{
+		Transport: proxyTransport(),
+		Timeout:   webhookTimeout,
+	}
+	for i := 1; ; i++ {
+		var resp *http.Response
+		resp, err = client.Post(url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("webhook returned %s", resp.Status)
+		}
+
+		if i == webhookRetries {
+			return err
+		}
+		time.Sleep(defaultSleep)
+	}
+}